@@ -0,0 +1,35 @@
+package graceful
+
+import "net"
+
+// acceptFuncListener admits connections through the Server's AcceptFunc.
+type acceptFuncListener struct {
+	net.Listener
+	accept func(net.Listener) (net.Conn, error)
+}
+
+func (l acceptFuncListener) Accept() (net.Conn, error) {
+	return l.accept(l.Listener)
+}
+
+// onAcceptListener runs the Server's OnAccept on each accepted connection,
+// closing the ones it fails for.
+type onAcceptListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l onAcceptListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if err := l.srv.OnAccept(conn); err != nil {
+			l.srv.logw(LevelWarn, map[string]interface{}{"error": err, "remote": conn.RemoteAddr().String()}, "rejected connection from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
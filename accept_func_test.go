@@ -0,0 +1,107 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAcceptFunc(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every other connection is dropped.
+	n := 0
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		NoSignalHandling: true,
+		AcceptFunc: func(l net.Listener) (net.Conn, error) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return nil, err
+				}
+				n++
+				if n%2 == 0 {
+					return c, nil
+				}
+				c.Close()
+			}
+		},
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	served := 0
+	for i := 0; i < 4; i++ {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		if resp, err := client.Get("http://" + l.Addr().String()); err == nil {
+			resp.Body.Close()
+			served++
+		}
+	}
+	if served != 2 {
+		t.Errorf("expected 2 requests to be served, got %d", served)
+	}
+	time.Sleep(waitTime)
+	if total := srv.Snapshot().TotalConnections; total != 2 {
+		t.Errorf("expected only the admitted connections to be tracked, got %d", total)
+	}
+
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
+
+func TestOnAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Warming up every other connection fails.
+	n := 0
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		NoSignalHandling: true,
+		OnAccept: func(c net.Conn) error {
+			n++
+			if n%2 == 0 {
+				return nil
+			}
+			return errors.New("warmup failed")
+		},
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	served := 0
+	for i := 0; i < 4; i++ {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		if resp, err := client.Get("http://" + l.Addr().String()); err == nil {
+			resp.Body.Close()
+			served++
+		}
+	}
+	if served != 2 {
+		t.Errorf("expected 2 requests to be served, got %d", served)
+	}
+	time.Sleep(waitTime)
+	if total := srv.Snapshot().TotalConnections; total != 2 {
+		t.Errorf("expected only the warmed up connections to be tracked, got %d", total)
+	}
+
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
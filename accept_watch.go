@@ -0,0 +1,48 @@
+package graceful
+
+import (
+	"net"
+	"time"
+)
+
+// acceptWatchListener notes when Accept goes without a connection for
+// AcceptIdleWarn, and when it keeps failing with the same error for that
+// long.
+type acceptWatchListener struct {
+	net.Listener
+	srv  *Server
+	warn time.Duration
+
+	// lastErr and failingSince describe the current run of identical
+	// Accept errors. Accept is only called from the serving goroutine.
+	lastErr      string
+	failingSince time.Time
+	warned       time.Time
+}
+
+func (srv *Server) acceptWatchListener(l net.Listener) net.Listener {
+	return &acceptWatchListener{Listener: l, srv: srv, warn: srv.AcceptIdleWarn}
+}
+
+func (l *acceptWatchListener) Accept() (net.Conn, error) {
+	timer := time.AfterFunc(l.warn, func() {
+		l.srv.logw(LevelDebug, map[string]interface{}{"duration": l.warn}, "no connection accepted in %s", l.warn)
+	})
+	c, err := l.Listener.Accept()
+	timer.Stop()
+
+	if err == nil {
+		l.lastErr = ""
+		return c, nil
+	}
+	now := time.Now()
+	if err.Error() != l.lastErr {
+		l.lastErr = err.Error()
+		l.failingSince = now
+		l.warned = now
+	} else if now.Sub(l.warned) >= l.warn {
+		l.warned = now
+		l.srv.logw(LevelWarn, map[string]interface{}{"duration": now.Sub(l.failingSince), "error": err}, "accept has been failing for %s: %s", now.Sub(l.failingSince), err)
+	}
+	return nil, err
+}
@@ -0,0 +1,76 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingListener is a net.Listener whose Accept always fails.
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	time.Sleep(time.Millisecond)
+	return nil, l.err
+}
+
+// logRecorder collects the messages logged through LogFunc.
+type logRecorder struct {
+	sync.Mutex
+	lines []string
+}
+
+func (r *logRecorder) logf(format string, args ...interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.lines = append(r.lines, format)
+}
+
+func (r *logRecorder) contains(s string) bool {
+	r.Lock()
+	defer r.Unlock()
+	for _, line := range r.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAcceptIdleWarn(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		var logs logRecorder
+		pl := newPipeListener()
+		srv := &Server{AcceptIdleWarn: waitTime / 2, LogFunc: logs.logf, LogDebug: debug}
+		l := srv.acceptWatchListener(pl)
+
+		go func() {
+			time.Sleep(waitTime)
+			pl.Close()
+		}()
+		l.Accept()
+		// Idleness is normal, so it is only noted when debugging.
+		if logs.contains("no connection accepted") != debug {
+			t.Errorf("expected a note about the idle accept loop only with LogDebug, got one with LogDebug %v", debug)
+		}
+	}
+}
+
+func TestAcceptIdleWarnRepeatedError(t *testing.T) {
+	var logs logRecorder
+	srv := &Server{AcceptIdleWarn: waitTime / 2, LogFunc: logs.logf}
+	l := srv.acceptWatchListener(failingListener{err: errors.New("too many open files")})
+
+	for start := time.Now(); time.Since(start) < waitTime; {
+		l.Accept()
+	}
+	if !logs.contains("accept has been failing") {
+		t.Error("expected a note about the repeated accept error")
+	}
+}
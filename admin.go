@@ -0,0 +1,55 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startAdmin begins serving AdminServer, if set, on its own listener.
+func (srv *Server) startAdmin() error {
+	if srv.AdminServer == nil {
+		return nil
+	}
+
+	addr := srv.AdminServer.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := srv.AdminServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			srv.logw(LevelError, map[string]interface{}{"error": err}, "admin server: %s", err)
+		}
+	}()
+	return nil
+}
+
+// stopAdmin shuts down AdminServer, if set, allowing its requests in
+// flight up to timeout to finish, indefinitely if timeout is zero, or not
+// at all if it is negative.
+func (srv *Server) stopAdmin(timeout time.Duration) {
+	if srv.AdminServer == nil {
+		return
+	}
+	if timeout < 0 {
+		srv.AdminServer.Close()
+		return
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := srv.AdminServer.Shutdown(ctx); err != nil {
+		srv.logw(LevelError, map[string]interface{}{"error": err}, "admin server: %s", err)
+		srv.AdminServer.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdminServer(t *testing.T) {
+	adminAddr := fmt.Sprintf("localhost:%d", port+1)
+	admin := &http.Server{
+		Addr: adminAddr,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}),
+	}
+
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: timeoutTime, Server: server, AdminServer: admin, NoSignalHandling: true}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	time.Sleep(waitTime)
+
+	// Keep the main server draining.
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	time.Sleep(waitTime)
+	srv.Stop(timeoutTime)
+	time.Sleep(waitTime)
+
+	res, err := http.Get("http://" + adminAddr)
+	if err != nil {
+		t.Fatalf("expected the admin server to be up while draining, got %s", err)
+	}
+	res.Body.Close()
+	select {
+	case <-srv.StopChan():
+		t.Fatal("expected the main server to still be draining")
+	default:
+	}
+
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + adminAddr); err == nil {
+		t.Error("expected the admin server to be shut down after the drain")
+	}
+}
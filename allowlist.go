@@ -0,0 +1,55 @@
+package graceful
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// drainAllowListener refuses connections from outside the DrainAllowlist
+// once the server is draining and ListenerCloseDelay has passed.
+type drainAllowListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l drainAllowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		if atomic.LoadInt32(&l.srv.allowlisting) == 0 || l.srv.drainAllowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.srv.stats.rejected()
+		conn.Close()
+	}
+}
+
+// remoteIP returns the IP of addr, or nil if it has none.
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// drainAllowed reports whether addr is in the DrainAllowlist.
+func (srv *Server) drainAllowed(addr net.Addr) bool {
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range srv.DrainAllowlist {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
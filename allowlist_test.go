@@ -0,0 +1,58 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainAllowlist(t *testing.T) {
+	for _, test := range []struct {
+		cidr    string
+		allowed bool
+	}{
+		{"127.0.0.0/8", true},
+		{"10.0.0.0/8", false},
+	} {
+		_, allowed, err := net.ParseCIDR(test.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{
+			Server:           &http.Server{Handler: http.NotFoundHandler()},
+			DrainAcceptGrace: killTime,
+			DrainAllowlist:   []net.IPNet{*allowed},
+			NoSignalHandling: true,
+		}
+		go srv.Serve(l)
+		time.Sleep(waitTime)
+
+		srv.Stop(0)
+		time.Sleep(waitTime)
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get("http://" + l.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		if test.allowed && err != nil {
+			t.Errorf("%s: expected the connection to be accepted while draining: %v", test.cidr, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("%s: expected the connection to be refused while draining", test.cidr)
+		}
+		if n := srv.DrainRejectedCount(); test.allowed != (n == 0) {
+			t.Errorf("%s: unexpected DrainRejectedCount %d", test.cidr, n)
+		}
+
+		select {
+		case <-srv.StopChan():
+		case <-time.After(timeoutTime):
+			t.Fatal("expected the server to stop after DrainAcceptGrace")
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrBacklogUnsupported is returned by ListenAndServe and ListenAndServeTLS
+// when ListenBacklog is set on a platform where it can't be applied.
+var ErrBacklogUnsupported = errors.New("ListenBacklog is not supported on this platform")
+
+// acceptIntervalWeight is the weight of the latest interval between two
+// accepted connections in the moving average reported as AcceptInterval.
+const acceptIntervalWeight = 8
+
+// acceptTimingListener records the interval between accepted connections.
+type acceptTimingListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (srv *Server) acceptTimingListener(l net.Listener) net.Listener {
+	return &acceptTimingListener{Listener: l, srv: srv}
+}
+
+func (l *acceptTimingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.srv.stats.accepted(time.Now())
+	}
+	return c, err
+}
@@ -0,0 +1,9 @@
+//+build appengine !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package graceful
+
+import "net"
+
+func listenBacklog(addr string, backlog int) (net.Listener, error) {
+	return nil, ErrBacklogUnsupported
+}
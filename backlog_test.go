@@ -0,0 +1,58 @@
+package graceful
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestListenBacklog(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", ":0"} {
+		srv := &Server{ListenBacklog: 16}
+		l, err := srv.newTCPListener(addr)
+		if err == ErrBacklogUnsupported {
+			t.Skipf("ListenBacklog is not supported on %s", runtime.GOOS)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		go func() {
+			if c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+				c.Close()
+			}
+		}()
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		c.Close()
+
+		// The address is taken now.
+		if l, err := srv.newTCPListener(l.Addr().String()); err == nil {
+			l.Close()
+			t.Errorf("%s: expected listening on a bound address to fail", addr)
+		}
+	}
+}
+
+func TestAcceptInterval(t *testing.T) {
+	srv := &Server{}
+	if d := srv.Snapshot().AcceptInterval; d != 0 {
+		t.Errorf("expected no accept interval before accepting, got %s", d)
+	}
+
+	start := time.Now()
+	srv.stats.accepted(start)
+	srv.stats.accepted(start.Add(80 * time.Millisecond))
+	if d := srv.Snapshot().AcceptInterval; d != 80*time.Millisecond {
+		t.Errorf("expected the first interval to be taken as is, got %s", d)
+	}
+	srv.stats.accepted(start.Add(80*time.Millisecond + 8*time.Millisecond))
+	if d := srv.Snapshot().AcceptInterval; d != 71*time.Millisecond {
+		t.Errorf("expected later intervals to be averaged in, got %s", d)
+	}
+}
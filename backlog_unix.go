@@ -0,0 +1,87 @@
+//+build !appengine
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenBacklog listens on the TCP address addr with a queue of backlog
+// connections waiting to be accepted. The kernel may cap it, e.g. at
+// net.core.somaxconn on Linux. net.Listen always listens with the system
+// default, so the socket is set up here and handed to net.FileListener.
+func listenBacklog(addr string, backlog int) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, sa, err := backlogSocket(tcpAddr)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: os.NewSyscallError("socket", err)}
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: os.NewSyscallError("setsockopt", err)}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: os.NewSyscallError("bind", err)}
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: os.NewSyscallError("listen", err)}
+	}
+	// FileListener works on a duplicate of the descriptor f closes.
+	return net.FileListener(f)
+}
+
+// backlogSocket opens a TCP socket for addr and returns the address to bind
+// it to. Like net.Listen, it listens on both IPv4 and IPv6 for an
+// unspecified IP where IPv6 is available.
+func backlogSocket(addr *net.TCPAddr) (int, syscall.Sockaddr, error) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+		fd, err := newSocket(syscall.AF_INET)
+		return fd, sa, err
+	}
+
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP)
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+	fd, err := newSocket(syscall.AF_INET6)
+	if err != nil {
+		if addr.IP != nil {
+			return -1, nil, err
+		}
+		// No IPv6, so listen on IPv4 only.
+		fd, err = newSocket(syscall.AF_INET)
+		return fd, &syscall.SockaddrInet4{Port: addr.Port}, err
+	}
+	if addr.IP == nil {
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}
+	return fd, sa, nil
+}
+
+// newSocket opens a TCP socket of the given family that isn't inherited by
+// child processes.
+func newSocket(family int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(fd)
+	return fd, nil
+}
@@ -0,0 +1,67 @@
+package graceful
+
+import (
+	"sync"
+	"time"
+)
+
+// barriers counts the drain barriers not acknowledged yet.
+type barriers struct {
+	sync.Mutex
+	pending int
+
+	// acked is closed once no barrier is pending.
+	acked chan struct{}
+}
+
+// RegisterDrainBarrier registers a component that must acknowledge being
+// ready for the process to exit, e.g. once its caches are flushed, and
+// returns the function it calls to do so. Once its connections have
+// drained, shutdown waits for all registered barriers to be acknowledged,
+// until Timeout expires. Acknowledging more than once has no further
+// effect.
+func (srv *Server) RegisterDrainBarrier() func() {
+	b := &srv.barriers
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pending == 0 {
+		b.acked = make(chan struct{})
+	}
+	b.pending++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.Lock()
+			defer b.Unlock()
+
+			b.pending--
+			if b.pending == 0 {
+				close(b.acked)
+			}
+		})
+	}
+}
+
+// waitBarriers waits for the registered drain barriers to be acknowledged
+// until deadline, if it isn't zero.
+func (srv *Server) waitBarriers(deadline time.Time) {
+	b := &srv.barriers
+	b.Lock()
+	pending, acked := b.pending, b.acked
+	b.Unlock()
+	if pending == 0 {
+		return
+	}
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		expired = time.After(time.Until(deadline))
+	}
+	select {
+	case <-acked:
+	case <-expired:
+		srv.logw(LevelWarn, nil, "drain barriers still not acknowledged when the timeout expired")
+	}
+}
@@ -0,0 +1,42 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainBarrier(t *testing.T) {
+	for _, acked := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+		first := srv.RegisterDrainBarrier()
+		second := srv.RegisterDrainBarrier()
+		go srv.Serve(l)
+		time.Sleep(waitTime)
+
+		srv.Stop(killTime)
+		first()
+		first()
+		time.Sleep(waitTime)
+		select {
+		case <-srv.StopChan():
+			t.Fatal("expected shutdown to wait for the unacknowledged barrier")
+		default:
+		}
+		if acked {
+			second()
+		}
+
+		// An unacknowledged barrier is given up on once Timeout expires.
+		select {
+		case <-srv.StopChan():
+		case <-time.After(killTime * 2):
+			t.Fatal("Timed out while waiting for the barriers")
+		}
+	}
+}
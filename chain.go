@@ -0,0 +1,37 @@
+package graceful
+
+import (
+	"context"
+	"time"
+)
+
+// ChainController shuts down a sequence of servers in order, e.g. a
+// frontend before the backend it depends on.
+type ChainController struct {
+	servers []*Server
+}
+
+// Chain returns a ChainController shutting down servers in the order
+// given. The servers must all be serving when Shutdown is called.
+func Chain(servers ...*Server) *ChainController {
+	return &ChainController{servers: servers}
+}
+
+// Shutdown drains each server in turn, allowing it up to timeout, with the
+// same meaning as for Stop, and waiting for it to stop completely before
+// starting on the next. It returns the first error a server's shutdown
+// ended with, such as ErrConnectionsLingering, after shutting down all of
+// them.
+func (c *ChainController) Shutdown(timeout time.Duration) error {
+	var first error
+	for _, srv := range c.servers {
+		srv.stopLock.Lock()
+		srv.Timeout = timeout
+		srv.stopLock.Unlock()
+
+		if err := srv.BeginShutdown().Wait(context.Background()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
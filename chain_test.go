@@ -0,0 +1,52 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+		go srv.Serve(l)
+		servers = append(servers, srv)
+	}
+	time.Sleep(waitTime)
+
+	// The backend must not begin shutting down before the frontend has
+	// stopped.
+	frontend, backend := servers[0], servers[1]
+	frontendStopped := make(chan bool, 1)
+	backend.ShutdownInitiated = func() {
+		select {
+		case <-frontend.StopChan():
+			frontendStopped <- true
+		default:
+			frontendStopped <- false
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- Chain(frontend, backend).Shutdown(timeoutTime) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the chain to shut down")
+	}
+	if !<-frontendStopped {
+		t.Error("expected the backend to serve until the frontend had stopped")
+	}
+	if backend.Snapshot().State != StateStopped {
+		t.Error("expected the backend to be stopped")
+	}
+}
@@ -0,0 +1,65 @@
+package graceful
+
+import (
+	"os"
+	"time"
+)
+
+// childExitInterval is how often stopChildren checks whether the child
+// processes have exited.
+const childExitInterval = 100 * time.Millisecond
+
+// stopChildren asks the processes returned by ChildProcesses, if set, to
+// exit and returns a channel closed once they have all exited, once
+// timeout has passed if positive, or right away if timeout is negative.
+// It never waits on the processes itself, so the application keeps their
+// exit status.
+func (srv *Server) stopChildren(timeout time.Duration) <-chan struct{} {
+	stopped := make(chan struct{})
+	if srv.ChildProcesses == nil {
+		close(stopped)
+		return stopped
+	}
+
+	procs := srv.ChildProcesses()
+	exited := make(chan struct{}, len(procs))
+	for _, p := range procs {
+		// Signaling a process that has already exited fails, which is
+		// what was asked for.
+		if err := stopChild(p); err != nil && !childExited(p) {
+			srv.logw(LevelError, map[string]interface{}{"error": err, "pid": p.Pid}, "signaling child process %d: %s", p.Pid, err)
+		}
+		go func(p *os.Process) {
+			ticker := time.NewTicker(childExitInterval)
+			defer ticker.Stop()
+			for !childExited(p) {
+				select {
+				case <-ticker.C:
+				case <-stopped:
+					return
+				}
+			}
+			exited <- struct{}{}
+		}(p)
+	}
+
+	go func() {
+		defer close(stopped)
+		if timeout < 0 {
+			return
+		}
+		var expired <-chan time.Time
+		if timeout > 0 {
+			expired = time.After(timeout)
+		}
+		for range procs {
+			select {
+			case <-exited:
+			case <-expired:
+				srv.logw(LevelWarn, map[string]interface{}{"timeout": timeout}, "child processes still running after %s", timeout)
+				return
+			}
+		}
+	}()
+	return stopped
+}
@@ -0,0 +1,17 @@
+//+build appengine !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package graceful
+
+import "os"
+
+// stopChild kills the child process p, as there is no SIGTERM to ask it
+// to exit on this platform.
+func stopChild(p *os.Process) error {
+	return p.Kill()
+}
+
+// childExited reports p as exited: it was killed, and there is no way to
+// check on it without waiting on it, which is left to the application.
+func childExited(p *os.Process) bool {
+	return true
+}
@@ -0,0 +1,92 @@
+//+build !appengine
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestChildProcesses(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+	srv := &Server{
+		Timeout:          timeoutTime,
+		Server:           &http.Server{},
+		NoSignalHandling: true,
+		ChildProcesses:   func() []*os.Process { return []*os.Process{cmd.Process} },
+	}
+
+	start := time.Now()
+	select {
+	case <-srv.stopChildren(timeoutTime):
+	case <-time.After(2 * timeoutTime):
+		t.Fatal("expected the child process to exit on SIGTERM")
+	}
+	if elapsed := time.Since(start); elapsed >= timeoutTime {
+		t.Errorf("expected the child process to exit promptly, took %s", elapsed)
+	}
+
+	// The application's own Wait must still get the exit status.
+	err := <-waited
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("expected an exit error from Wait, got %v", err)
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); !ok || status.Signal() != syscall.SIGTERM {
+		t.Errorf("expected the child process to be terminated by SIGTERM, got %v", exitErr)
+	}
+}
+
+func TestChildProcessesTimeout(t *testing.T) {
+	// The shell ignores SIGTERM, so only the timeout ends the wait.
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	srv := &Server{
+		Server:         &http.Server{},
+		ChildProcesses: func() []*os.Process { return []*os.Process{cmd.Process} },
+	}
+
+	select {
+	case <-srv.stopChildren(waitTime):
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the wait for child processes to time out")
+	}
+}
+
+func TestChildProcessesExited(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	var buf bytes.Buffer
+	srv := &Server{
+		Server:         &http.Server{},
+		Logger:         log.New(&buf, "", 0),
+		ChildProcesses: func() []*os.Process { return []*os.Process{cmd.Process} },
+	}
+
+	select {
+	case <-srv.stopChildren(timeoutTime):
+	case <-time.After(timeoutTime):
+		t.Fatal("expected an exited child process not to be waited for")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected signaling an exited child process not to be logged, got %q", buf.String())
+	}
+}
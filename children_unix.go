@@ -0,0 +1,21 @@
+//+build !appengine
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopChild asks the child process p to exit.
+func stopChild(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
+
+// childExited reports whether p has exited and been waited on by its
+// owner. Signal 0 only checks that p still exists, so unlike Wait it
+// leaves reaping p, and its exit status, to the application.
+func childExited(p *os.Process) bool {
+	return p.Signal(syscall.Signal(0)) != nil
+}
@@ -0,0 +1,146 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey struct {
+	name string
+}
+
+// connContextKey is the context key under which graceful stores the
+// net.Conn serving a request.
+var connContextKey = &contextKey{"graceful-conn"}
+
+// connRecordContextKey is the context key under which graceful stores the
+// connRecord of the connection serving a request.
+var connRecordContextKey = &contextKey{"graceful-conn-record"}
+
+// requestContextKey is the context key under which graceful stores the
+// tracked request for MarkCritical.
+var requestContextKey = &contextKey{"graceful-request"}
+
+// ConnFromContext returns the connection serving the request whose context
+// is ctx. It only succeeds for requests served by a graceful Server.
+func ConnFromContext(ctx context.Context) (net.Conn, bool) {
+	conn, ok := ctx.Value(connContextKey).(net.Conn)
+	return conn, ok
+}
+
+// connCancels holds the functions cancelling the context of each
+// connection, so that killing a connection aborts the work done on its
+// behalf.
+type connCancels struct {
+	sync.Mutex
+	cancels map[net.Conn]context.CancelFunc
+}
+
+// add records cancel as cancelling the context of conn.
+func (c *connCancels) add(conn net.Conn, cancel context.CancelFunc) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.cancels == nil {
+		c.cancels = map[net.Conn]context.CancelFunc{}
+	}
+	c.cancels[conn] = cancel
+}
+
+// take forgets the cancel function of conn and returns it, or nil if there
+// is none.
+func (c *connCancels) take(conn net.Conn) context.CancelFunc {
+	c.Lock()
+	defer c.Unlock()
+
+	cancel := c.cancels[conn]
+	delete(c.cancels, conn)
+	return cancel
+}
+
+// cancel cancels the context of conn, if it is still known.
+func (c *connCancels) cancel(conn net.Conn) {
+	if cancel := c.take(conn); cancel != nil {
+		cancel()
+	}
+}
+
+// ConnInfo describes the connection serving a request as graceful tracks
+// it, e.g. to annotate logs and traces.
+type ConnInfo struct {
+	// Age is how long ago the connection was accepted.
+	Age time.Duration
+
+	// State is the connection's current state.
+	State http.ConnState
+
+	// Critical reports whether the request has been marked by
+	// MarkCritical.
+	Critical bool
+}
+
+// ConnInfoFromContext returns the ConnInfo of the connection serving the
+// request whose context is ctx. It only succeeds for requests served by a
+// graceful Server.
+func ConnInfoFromContext(ctx context.Context) (ConnInfo, bool) {
+	rec, ok := ctx.Value(connRecordContextKey).(*connRecord)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	info := ConnInfo{
+		Age:   time.Since(rec.accepted),
+		State: http.ConnState(atomic.LoadInt32(&rec.state)),
+	}
+	if req, ok := ctx.Value(requestContextKey).(*request); ok {
+		info.Critical = atomic.LoadInt32(&req.critical) == 1
+	}
+	return info, true
+}
+
+// connRecord is what graceful knows about a connection for ConnInfo.
+type connRecord struct {
+	accepted time.Time
+
+	// state holds the http.ConnState of the connection.
+	state int32
+}
+
+// connRecords holds the connRecord of each open connection, so that its
+// state can be kept up to date.
+type connRecords struct {
+	sync.Mutex
+	records map[net.Conn]*connRecord
+}
+
+// add records a newly accepted conn and returns its record.
+func (c *connRecords) add(conn net.Conn) *connRecord {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.records == nil {
+		c.records = map[net.Conn]*connRecord{}
+	}
+	rec := &connRecord{accepted: time.Now(), state: int32(http.StateNew)}
+	c.records[conn] = rec
+	return rec
+}
+
+// setState updates the state of conn, forgetting it once graceful no
+// longer tracks it.
+func (c *connRecords) setState(conn net.Conn, state http.ConnState) {
+	c.Lock()
+	defer c.Unlock()
+
+	rec, ok := c.records[conn]
+	if !ok {
+		return
+	}
+	atomic.StoreInt32(&rec.state, int32(state))
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(c.records, conn)
+	}
+}
@@ -0,0 +1,54 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnInfoFromContext(t *testing.T) {
+	if _, ok := ConnInfoFromContext(context.Background()); ok {
+		t.Error("expected no ConnInfo outside of a graceful Server")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make(chan ConnInfo, 1)
+	srv := &Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			MarkCritical(r)
+			info, ok := ConnInfoFromContext(r.Context())
+			if !ok {
+				t.Error("expected the ConnInfo to be stored in the request context")
+			}
+			infos <- info
+		})},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	info := <-infos
+	if info.State != http.StateActive || !info.Critical {
+		t.Errorf("expected an active connection serving a critical request, got %+v", info)
+	}
+	if info.Age < waitTime {
+		t.Errorf("expected the connection's age to count from its acceptance, got %s", info.Age)
+	}
+}
@@ -0,0 +1,138 @@
+package graceful
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+)
+
+// Commands understood on the ControlSocket, one per line.
+const (
+	// ControlStatus answers with the Snapshot as a line of JSON.
+	ControlStatus = "status"
+
+	// ControlDrain shuts the server down gracefully, as if Stop(Timeout)
+	// had been called.
+	ControlDrain = "drain"
+
+	// ControlForceStop shuts the server down, killing the connections
+	// right away.
+	ControlForceStop = "force-stop"
+)
+
+// ErrControlSocketInUse is returned by Serve when another process is
+// listening on the ControlSocket.
+var ErrControlSocketInUse = errors.New("control socket is in use by another process")
+
+// startControl begins listening on ControlSocket, if set.
+func (srv *Server) startControl() error {
+	if srv.ControlSocket == "" {
+		return nil
+	}
+
+	if err := removeStaleSocket(srv.ControlSocket); err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", srv.ControlSocket)
+	if err != nil {
+		return err
+	}
+	// Anyone able to connect could stop the server. Windows controls
+	// access to sockets differently.
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(srv.ControlSocket, 0600); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	srv.chanLock.Lock()
+	srv.control = l
+	srv.chanLock.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+// removeStaleSocket removes the socket file at path left behind by a
+// process that exited without closing it, so that it can be listened on
+// again. Sockets still listened on and other files are left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return ErrControlSocketInUse
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// stopControl closes the ControlSocket, if open, removing its file.
+func (srv *Server) stopControl() {
+	srv.chanLock.Lock()
+	l := srv.control
+	srv.control = nil
+	srv.chanLock.Unlock()
+
+	if l != nil {
+		l.Close()
+	}
+}
+
+// serveControl answers the commands received on conn, one line each.
+func (srv *Server) serveControl(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var reply string
+		switch cmd := scanner.Text(); cmd {
+		case ControlStatus:
+			b, err := json.Marshal(srv.Snapshot())
+			if err != nil {
+				reply = "error: " + err.Error()
+				break
+			}
+			reply = string(b)
+		case ControlDrain:
+			srv.stopLock.Lock()
+			srv.interruptChan() <- stopSignal{}
+			srv.stopLock.Unlock()
+			reply = "ok"
+		case ControlForceStop:
+			srv.chanLock.RLock()
+			hurry := srv.hurry
+			srv.chanLock.RUnlock()
+			if hurry == nil {
+				reply = "error: " + ErrNotServing.Error()
+				break
+			}
+			expedite(hurry, 0)
+			srv.stopLock.Lock()
+			srv.interruptChan() <- stopSignal{}
+			srv.stopLock.Unlock()
+			reply = "ok"
+		default:
+			reply = fmt.Sprintf("error: unknown command %q", cmd)
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
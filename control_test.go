@@ -0,0 +1,148 @@
+//+build !windows
+
+package graceful
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, ControlSocket: path, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	replies := bufio.NewScanner(conn)
+	command := func(cmd string) string {
+		t.Helper()
+		fmt.Fprintln(conn, cmd)
+		if !replies.Scan() {
+			t.Fatalf("expected a reply to %s: %v", cmd, replies.Err())
+		}
+		return replies.Text()
+	}
+
+	var status struct {
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal([]byte(command(ControlStatus)), &status); err != nil || status.State != StateServing.String() {
+		t.Errorf("expected the status to be serving, got %+v, %v", status, err)
+	}
+	if reply := command("bogus"); reply == "ok" {
+		t.Error("expected an unknown command to be rejected")
+	}
+
+	// Keep the server draining until it is forced to stop.
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	time.Sleep(waitTime)
+	if reply := command(ControlDrain); reply != "ok" {
+		t.Fatalf("expected the drain to be accepted, got %s", reply)
+	}
+	time.Sleep(waitTime)
+	if err := json.Unmarshal([]byte(command(ControlStatus)), &status); err != nil || status.State != StateDraining.String() {
+		t.Errorf("expected the status to be draining, got %+v, %v", status, err)
+	}
+	if reply := command(ControlForceStop); reply != "ok" {
+		t.Fatalf("expected the force stop to be accepted, got %s", reply)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the server to stop right away")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the control socket to be removed, got %v", err)
+	}
+}
+
+func TestControlSocketStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	// A crashed process leaves its socket file behind.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	server, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, ControlSocket: path, NoSignalHandling: true}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	time.Sleep(waitTime)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected the socket to be accessible to its owner only, got %s", perm)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced: %v", err)
+	}
+	conn.Close()
+
+	srv.Stop(0)
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestControlSocketInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	other, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	server, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, ControlSocket: path, NoSignalHandling: true}
+	if err := srv.Serve(l); err != ErrControlSocketInUse {
+		t.Errorf("expected ErrControlSocketInUse, got %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package graceful
+
+import "time"
+
+// drainRequestsInterval is how often awaitRequests checks the number of
+// completed requests.
+const drainRequestsInterval = 10 * time.Millisecond
+
+// awaitRequests waits for DrainRequests more requests to complete, then
+// asks the drain to take no longer than what is left of the shutdown's
+// timeout. If the timeout expires first, the drain is asked to kill the
+// connections right away.
+func (srv *Server) awaitRequests(hurry chan time.Duration) {
+	start := time.Now()
+	timeout := srv.shutdownTimeout()
+	target := srv.stats.completedCount() + uint64(srv.DrainRequests)
+
+	var expired <-chan time.Time
+	if timeout != 0 {
+		expired = time.After(timeout)
+	}
+	ticker := time.NewTicker(drainRequestsInterval)
+	defer ticker.Stop()
+	for srv.stats.completedCount() < target {
+		select {
+		case <-ticker.C:
+		case <-expired:
+			srv.logw(LevelWarn, map[string]interface{}{"timeout": timeout}, "timed out waiting for %d requests to complete", srv.DrainRequests)
+			expedite(hurry, 0)
+			return
+		}
+	}
+	if timeout != 0 {
+		expedite(hurry, timeout-time.Since(start))
+	}
+}
@@ -0,0 +1,64 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		DrainRequests:    2,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	srv.Stop(0)
+	time.Sleep(waitTime)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-srv.StopChan():
+			t.Fatalf("expected the server to keep serving until 2 requests completed, got %d", i)
+		default:
+		}
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatalf("expected the request to be served while draining: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the server to stop once the requests completed")
+	}
+}
+
+func TestDrainRequestsTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		DrainRequests:    1,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the server to stop once Timeout expired")
+	}
+}
@@ -0,0 +1,82 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DefaultTimeout is the drain timeout RunEnv uses unless TimeoutEnv is set.
+const DefaultTimeout = 10 * time.Second
+
+const (
+	// TimeoutEnv is the environment variable RunEnv reads the drain
+	// timeout from, as understood by time.ParseDuration, e.g. "30s".
+	TimeoutEnv = "GRACEFUL_TIMEOUT"
+
+	// ImmediateEnv is the environment variable that, when set to a true
+	// value as understood by strconv.ParseBool, makes RunEnv shut down
+	// immediately on SIGINT and SIGTERM rather than draining, e.g. for an
+	// instant Ctrl-C during development.
+	ImmediateEnv = "GRACEFUL_IMMEDIATE"
+)
+
+// RunEnv is like Run, but configures shutdown from the environment: the
+// drain timeout is read from TimeoutEnv, defaulting to DefaultTimeout, and
+// ImmediateEnv chooses between draining and shutting down immediately on
+// signals. This lets the same binary drain gracefully in production while
+// stopping right away locally. It exits the program if the environment is
+// invalid.
+func RunEnv(addr string, h http.Handler) {
+	srv, err := serverFromEnv(addr, h)
+	if err != nil {
+		DefaultLogger().Printf("%s", err)
+		runExit(err)
+		os.Exit(1)
+	}
+
+	if err := srv.ListenAndServe(); err != nil {
+		srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+		runExit(err)
+		os.Exit(1)
+	}
+	runExit(nil)
+}
+
+// serverFromEnv builds the Server RunEnv runs.
+func serverFromEnv(addr string, h http.Handler) (*Server, error) {
+	srv := &Server{
+		Timeout:      DefaultTimeout,
+		TCPKeepAlive: 3 * time.Minute,
+		Server:       &http.Server{Addr: addr, Handler: h},
+		Logger:       DefaultLogger(),
+	}
+
+	if v := os.Getenv(TimeoutEnv); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", TimeoutEnv, err)
+		}
+		srv.Timeout = timeout
+	}
+	if v := os.Getenv(ImmediateEnv); v != "" {
+		immediate, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", ImmediateEnv, err)
+		}
+		if immediate {
+			srv.SignalModes = map[os.Signal]ShutdownMode{
+				os.Interrupt:    Immediate,
+				syscall.SIGTERM: Immediate,
+			}
+		}
+	}
+
+	if err := srv.Validate(); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
@@ -0,0 +1,50 @@
+package graceful
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServerFromEnv(t *testing.T) {
+	tests := []struct {
+		timeout, immediate string
+		expected           time.Duration
+		expectImmediate    bool
+		shouldErr          bool
+	}{
+		{"", "", DefaultTimeout, false, false},
+		{"30s", "", 30 * time.Second, false, false},
+		{"0", "false", 0, false, false},
+		{"", "true", DefaultTimeout, true, false},
+		{"soon", "", 0, false, true},
+		{"-1s", "", 0, false, true},
+		{"", "maybe", 0, false, true},
+	}
+	defer os.Unsetenv(TimeoutEnv)
+	defer os.Unsetenv(ImmediateEnv)
+
+	for _, test := range tests {
+		os.Setenv(TimeoutEnv, test.timeout)
+		os.Setenv(ImmediateEnv, test.immediate)
+
+		srv, err := serverFromEnv(":0", http.NotFoundHandler())
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("%q, %q: expected an error", test.timeout, test.immediate)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, %q: unexpected error %s", test.timeout, test.immediate, err)
+			continue
+		}
+		if srv.Timeout != test.expected {
+			t.Errorf("%q, %q: expected timeout %s, got %s", test.timeout, test.immediate, test.expected, srv.Timeout)
+		}
+		if immediate := srv.SignalModes[os.Interrupt] == Immediate; immediate != test.expectImmediate {
+			t.Errorf("%q, %q: expected immediate %t, got %t", test.timeout, test.immediate, test.expectImmediate, immediate)
+		}
+	}
+}
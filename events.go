@@ -0,0 +1,87 @@
+package graceful
+
+import "time"
+
+// EventKind identifies a lifecycle event published by a Server.
+type EventKind int
+
+const (
+	// EventStarted is published when Serve starts accepting connections.
+	EventStarted EventKind = iota
+
+	// EventDraining is published when shutdown begins. Remaining holds
+	// the number of open connections.
+	EventDraining
+
+	// EventConnClosed is published when a tracked connection is closed or
+	// hijacked. Remaining holds the number of connections still open.
+	EventConnClosed
+
+	// EventKilled is published when Timeout expires. Count holds the number
+	// of connections that were forcefully closed.
+	EventKilled
+
+	// EventStopped is published once shutdown has completed.
+	EventStopped
+)
+
+var eventKindNames = map[EventKind]string{
+	EventStarted:    "started",
+	EventDraining:   "draining",
+	EventConnClosed: "conn closed",
+	EventKilled:     "killed",
+	EventStopped:    "stopped",
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes a change in a Server's lifecycle.
+type Event struct {
+	Kind      EventKind
+	Time      time.Time
+	Remaining int
+	Count     int
+
+	// Server is the Name of the server that published the event.
+	Server string
+}
+
+// eventBuffer is the number of events kept for a slow consumer before
+// further events are dropped.
+const eventBuffer = 64
+
+// Events returns the channel on which the server publishes its lifecycle
+// events. Publishing never blocks the server: events are dropped while
+// the channel's buffer is full. The same channel is returned on every
+// call and is never closed.
+func (srv *Server) Events() <-chan Event {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.events == nil {
+		srv.events = make(chan Event, eventBuffer)
+	}
+	return srv.events
+}
+
+// publish sends e to the Events channel, if anyone asked for it.
+func (srv *Server) publish(e Event) {
+	srv.chanLock.RLock()
+	events := srv.events
+	srv.chanLock.RUnlock()
+
+	if events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Server = srv.Name
+	select {
+	case events <- e:
+	default:
+	}
+}
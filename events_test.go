@@ -0,0 +1,92 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func collectEvents(events <-chan Event) []Event {
+	var collected []Event
+	for {
+		select {
+		case e := <-events:
+			collected = append(collected, e)
+		default:
+			return collected
+		}
+	}
+}
+
+func eventKinds(events []Event) []EventKind {
+	kinds := make([]EventKind, len(events))
+	for i, e := range events {
+		kinds[i] = e.Kind
+	}
+	return kinds
+}
+
+func TestEventsDrain(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, interrupt: c}
+	events := srv.Events()
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+
+	c <- os.Interrupt
+	<-srv.StopChan()
+
+	expected := []EventKind{EventStarted, EventDraining, EventConnClosed, EventStopped}
+	if kinds := eventKinds(collectEvents(events)); fmt.Sprint(kinds) != fmt.Sprint(expected) {
+		t.Errorf("unexpected events %v, expected %v", kinds, expected)
+	}
+}
+
+func TestEventsKilled(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime / 2, Server: server, interrupt: c}
+	events := srv.Events()
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	c <- os.Interrupt
+	<-srv.StopChan()
+	wg.Wait()
+
+	collected := collectEvents(events)
+	if len(collected) < 2 {
+		t.Fatalf("expected at least two events, got %v", collected)
+	}
+	killed, stopped := collected[len(collected)-2], collected[len(collected)-1]
+	if killed.Kind != EventKilled || killed.Count != 1 {
+		t.Errorf("expected one connection to be killed, got %+v", killed)
+	}
+	if stopped.Kind != EventStopped {
+		t.Errorf("expected the last event to be %s, got %s", EventStopped, stopped.Kind)
+	}
+}
@@ -0,0 +1,33 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"os"
+)
+
+// ServeAndExit serves on l like Serve and then exits the program, after
+// calling OnExit, with cleanCode if the server shut down cleanly or
+// errorCode if Serve failed, e.g. so that a supervisor restarts the process
+// depending on how it ended. With StdErrServerClosed, http.ErrServerClosed
+// counts as a clean shutdown.
+func (srv *Server) ServeAndExit(l net.Listener, cleanCode, errorCode int) {
+	err := srv.Serve(l)
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	if err != nil {
+		srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+	}
+	runExit(err)
+	os.Exit(exitCode(err, cleanCode, errorCode))
+}
+
+// exitCode maps the error Serve returned to the code ServeAndExit exits
+// with.
+func exitCode(err error, cleanCode, errorCode int) int {
+	if err != nil {
+		return errorCode
+	}
+	return cleanCode
+}
@@ -0,0 +1,45 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// serveAndExitEnv makes TestServeAndExit run ServeAndExit in a child
+// process, failing to start if it is "fail".
+const serveAndExitEnv = "GRACEFUL_SERVE_AND_EXIT"
+
+func TestServeAndExit(t *testing.T) {
+	if mode := os.Getenv(serveAndExitEnv); mode != "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			os.Exit(1)
+		}
+		srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+		if mode == "fail" {
+			srv.Handler = nil
+		} else {
+			// The stop is picked up once serving begins.
+			srv.Stop(0)
+		}
+		srv.ServeAndExit(l, 3, 4)
+		return
+	}
+
+	for mode, want := range map[string]int{"clean": 3, "fail": 4} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestServeAndExit$")
+		cmd.Env = append(os.Environ(), serveAndExitEnv+"="+mode)
+		err := cmd.Run()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Errorf("%s: expected the process to exit with %d, got %v", mode, want, err)
+			continue
+		}
+		if code := exitErr.ExitCode(); code != want {
+			t.Errorf("%s: expected exit code %d, got %d", mode, want, code)
+		}
+	}
+}
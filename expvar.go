@@ -0,0 +1,57 @@
+package graceful
+
+import (
+	"expvar"
+	"sync"
+)
+
+// defaultExpvarName is the expvar name used when ExpvarName is empty.
+const defaultExpvarName = "graceful"
+
+// expvars maps the names published by ExportExpvar to the Server most
+// recently exported under each, since expvar names can't be published
+// twice.
+var expvars = struct {
+	sync.Mutex
+	servers map[string]*Server
+}{servers: make(map[string]*Server)}
+
+// exportExpvar publishes the server's counters under ExpvarName.
+func (srv *Server) exportExpvar() {
+	name := srv.ExpvarName
+	if name == "" {
+		name = defaultExpvarName
+	}
+
+	expvars.Lock()
+	defer expvars.Unlock()
+
+	if _, ok := expvars.servers[name]; !ok {
+		if expvar.Get(name) != nil {
+			srv.logw(LevelError, map[string]interface{}{"name": name}, "expvar %s is already published", name)
+			return
+		}
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			expvars.Lock()
+			srv := expvars.servers[name]
+			expvars.Unlock()
+			return srv.expvarValue()
+		}))
+	}
+	expvars.servers[name] = srv
+}
+
+// expvarValue returns the counters published by ExportExpvar.
+func (srv *Server) expvarValue() map[string]interface{} {
+	srv.stats.Lock()
+	defer srv.stats.Unlock()
+
+	return map[string]interface{}{
+		"state":                 srv.stats.state.String(),
+		"connections":           srv.stats.live,
+		"peak_connections":      srv.stats.peak,
+		"total_connections":     srv.stats.total,
+		"killed_connections":    srv.stats.killed,
+		"last_shutdown_seconds": srv.stats.lastShutdown.Seconds(),
+	}
+}
@@ -0,0 +1,33 @@
+package graceful
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestExportExpvar(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, ExportExpvar: true, ExpvarName: "graceful_test", NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	srv.Stop(0)
+	<-srv.StopChan()
+
+	v := expvar.Get("graceful_test")
+	if v == nil {
+		t.Fatal("expected the expvar to be published")
+	}
+	var vars map[string]interface{}
+	if err := json.Unmarshal([]byte(v.String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars["state"] != "stopped" || vars["last_shutdown_seconds"].(float64) <= 0 {
+		t.Errorf("unexpected expvar %s", v)
+	}
+}
@@ -0,0 +1,42 @@
+package graceful
+
+import "runtime/debug"
+
+// DefaultShutdownGCPercent is the GC percentage TuneGCOnShutdown sets
+// unless ShutdownGCPercent is set. It is higher than the runtime's default
+// of 100, trading memory for fewer collections during the drain.
+const DefaultShutdownGCPercent = 400
+
+// gcTuning is the GC percentage in effect before TuneGCOnShutdown
+// changed it.
+type gcTuning struct {
+	tuned   bool
+	percent int
+}
+
+// tuneGC applies ShutdownGCPercent if TuneGCOnShutdown is set.
+func (srv *Server) tuneGC() {
+	if !srv.TuneGCOnShutdown {
+		return
+	}
+	percent := srv.ShutdownGCPercent
+	if percent == 0 {
+		percent = DefaultShutdownGCPercent
+	}
+
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+	if !srv.gcTuning.tuned {
+		srv.gcTuning = gcTuning{tuned: true, percent: debug.SetGCPercent(percent)}
+	}
+}
+
+// restoreGC restores the GC percentage changed by tuneGC.
+func (srv *Server) restoreGC() {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+	if srv.gcTuning.tuned {
+		debug.SetGCPercent(srv.gcTuning.percent)
+		srv.gcTuning = gcTuning{}
+	}
+}
@@ -0,0 +1,41 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+func TestTuneGCOnShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	percents := make(chan int, 1)
+	srv := &Server{
+		Server:            &http.Server{Handler: http.NotFoundHandler()},
+		TuneGCOnShutdown:  true,
+		ShutdownGCPercent: 250,
+		DrainComplete: func() bool {
+			// Reading the percentage requires setting it.
+			percents <- debug.SetGCPercent(250)
+			return true
+		},
+		NoSignalHandling: true,
+	}
+	before := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(before)
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	srv.Stop(0)
+	if p := <-percents; p != 250 {
+		t.Errorf("expected the GC percentage to be tuned during shutdown, got %d", p)
+	}
+	<-srv.StopChan()
+	if p := debug.SetGCPercent(100); p != 100 {
+		t.Errorf("expected the GC percentage to be restored after shutdown, got %d", p)
+	}
+}
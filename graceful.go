@@ -1,12 +1,17 @@
 package graceful
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,12 +29,63 @@ type Server struct {
 	*http.Server
 
 	// Timeout is the duration to allow outstanding requests to survive
-	// before forcefully terminating them.
+	// before forcefully terminating them. If it is zero, shutdown waits
+	// for requests to finish indefinitely. A negative Timeout is rejected
+	// by Validate; if one is used anyway, e.g. passed to Stop, connections
+	// are killed immediately.
 	Timeout time.Duration
 
+	// TimeoutFunc, if set, computes the timeout of each shutdown from the
+	// number of connections serving requests when it begins, e.g. to allow
+	// a second per 100 of them, capped at 30 seconds. It overrides Timeout,
+	// including one passed to Stop, and its result is interpreted the same.
+	TimeoutFunc func(active int) time.Duration
+
+	// TriggerTimeouts, if set, gives the timeout of shutdowns initiated by
+	// particular triggers, overriding Timeout and TimeoutFunc, e.g. a short
+	// one for a developer's SIGINT and a long one for a scale-down
+	// SIGTERM. Triggers are named as by the Trigger constants, or by the
+	// signal's String method for other signals. The timeouts StopAndWait
+	// and TimedCancel shut down with aren't overridden.
+	TriggerTimeouts map[string]time.Duration
+
 	// Limit the number of outstanding requests
 	ListenLimit int
 
+	// MaxConnsPerIP, if set, limits how many connections each remote IP
+	// may have open. Further connections from it are closed as soon as
+	// they are accepted. When KillRate or MaxConcurrentCloses spread out
+	// killing connections at shutdown, those from IPs that have used up
+	// their quota go first.
+	MaxConnsPerIP int
+
+	// AcceptFunc, if set, is called instead of the listener's Accept to
+	// admit connections, e.g. to favour some source networks during
+	// overload. It may inspect each connection it accepts and close it and
+	// accept another rather than return it. Only the connections it returns
+	// are served and tracked for shutdown; an error it returns is handled
+	// like an error from Accept.
+	AcceptFunc func(net.Listener) (net.Conn, error)
+
+	// OnAccept, if set, is called with each accepted connection before it
+	// is served, e.g. to warm up a backend session for it. If it returns
+	// an error, the connection is closed without being served. It runs in
+	// the accept loop, so no other connection is accepted meanwhile.
+	OnAccept func(net.Conn) error
+
+	// ListenBacklog, if set, is the length of the queue of connections
+	// waiting to be accepted on the listener created by ListenAndServe and
+	// ListenAndServeTLS, instead of the system default. The system may cap
+	// it. Setting it is only supported on Unix.
+	ListenBacklog int
+
+	// RebindOnFailure, if set, is how many times the listener created by
+	// ListenAndServe and ListenAndServeTLS is replaced by a new one on the
+	// same address when it fails other than by being shut down, so that
+	// serving resumes. Once the rebinds are used up, or one of them fails,
+	// Serve returns the listener's error as usual.
+	RebindOnFailure int
+
 	// TCPKeepAlive sets the TCP keep-alive timeouts on accepted
 	// connections. It prunes dead TCP connections ( e.g. closing
 	// laptop mid-download)
@@ -38,23 +94,341 @@ type Server struct {
 	// ConnState specifies an optional callback function that is
 	// called when a client connection changes state. This is a proxy
 	// to the underlying http.Server's ConnState, and the original
-	// must not be set directly.
+	// should not be set directly. If it is, it is chained after this
+	// one; if it was installed by another graceful Server that is still
+	// serving, Serve returns ErrConnStateInUse.
 	ConnState func(net.Conn, http.ConnState)
 
+	// ConnContext optionally specifies a function that modifies the
+	// context used for a new connection. This is a proxy to the
+	// underlying http.Server's ConnContext, and the original must not be
+	// set directly. The context is cancelled when the connection is killed
+	// because Timeout expired, before the connection is closed, so that
+	// work done on its behalf is aborted.
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
 	// BeforeShutdown is an optional callback function that is called
-	// before the listener is closed. Returns true if shutdown is allowed
+	// before the listener is closed. Returns true if shutdown is allowed.
+	// It is called before any connection is closed, so it can also be
+	// used to prepare for the drain, e.g. by tuning the runtime.
 	BeforeShutdown func() bool
 
+	// BeforeShutdownContext is like BeforeShutdown, and is called after it
+	// if both are set and BeforeShutdown allowed shutdown. Its context's
+	// deadline is the earliest the drain may kill the remaining
+	// connections, if Timeout limits it, and the context is cancelled once
+	// shutdown has completed.
+	BeforeShutdownContext func(ctx context.Context) bool
+
+	// TuneGCOnShutdown sets the garbage collection target percentage, as
+	// with debug.SetGCPercent, to ShutdownGCPercent, or
+	// DefaultShutdownGCPercent if it is zero, for the duration of each
+	// shutdown, to reduce GC churn while connections drain. The previous
+	// value is restored once shutdown completes.
+	TuneGCOnShutdown  bool
+	ShutdownGCPercent int
+
 	// ShutdownInitiated is an optional callback function that is called
 	// when shutdown is initiated. It can be used to notify the client
 	// side of long lived connections (e.g. websockets) to reconnect.
 	ShutdownInitiated func()
 
+	// ShutdownInitiatedContext is like ShutdownInitiated, and is called
+	// after it if both are set, with a context like BeforeShutdownContext's.
+	ShutdownInitiatedContext func(ctx context.Context)
+
+	// OnCloseError is an optional callback function that is called when
+	// closing a connection during shutdown fails. Such connections may
+	// not actually have been terminated.
+	OnCloseError func(conn net.Conn, err error)
+
+	// CloseConn, if set, is used instead of Close to close connections
+	// killed because Timeout expired, e.g. to set SO_LINGER or to
+	// half-close them before closing them for a cleaner TCP teardown. It
+	// must eventually close the connection. An error it returns is
+	// reported like one from Close.
+	CloseConn func(net.Conn) error
+
+	// OnConnClose, if set, is called when a tracked connection goes away,
+	// with the reason why. It is called from the goroutine tracking
+	// connections and must not block.
+	OnConnClose func(conn net.Conn, reason CloseReason)
+
+	// OnRequestKilled, if set, is called for each request in flight on a
+	// connection killed because Timeout expired, whether or not its
+	// response had begun. It is called from the goroutine tracking
+	// connections and must not block.
+	OnRequestKilled func(KilledRequest)
+
+	// GracefulStopper is an optional function that is called when shutdown
+	// begins, before graceful closes any connections itself. It allows
+	// servers with their own shutdown protocol, such as grpc.Server's
+	// GracefulStop, to wind down their connections cleanly. The context is
+	// cancelled when Timeout expires, after which the remaining connections
+	// are killed.
+	GracefulStopper func(ctx context.Context) error
+
 	// NoSignalHandling prevents graceful from automatically shutting down
 	// on SIGINT and SIGTERM. If set to true, you must shut down the server
 	// manually with Stop().
 	NoSignalHandling bool
 
+	// SignalModes optionally maps the signals graceful handles (SIGINT and
+	// SIGTERM) to the way the server shuts down when receiving them.
+	// Signals not present shut down gracefully. An Immediate signal
+	// received while already draining kills the remaining connections.
+	SignalModes map[os.Signal]ShutdownMode
+
+	// AllowDefaultMux permits serving http.DefaultServeMux when the
+	// http.Server has no Handler. Without it Serve returns ErrNoHandler, so
+	// that a forgotten Handler doesn't silently expose the default mux.
+	AllowDefaultMux bool
+
+	// EscalationTimeouts shortens the drain when shutdown is requested
+	// again while already shutting down, e.g. by an impatient operator.
+	// The n-th repeated request limits the remaining drain to the n-th
+	// duration; a zero duration kills the remaining connections right
+	// away. Requests beyond the end of the list are ignored.
+	EscalationTimeouts []time.Duration
+
+	// MaxInFlight, if set, limits how many requests are handled at once.
+	// Up to MaxQueue further requests wait for their turn, and requests
+	// beyond that are answered with 503 Service Unavailable. Waiting
+	// requests are still served while draining, so shutdown keeps to the
+	// same limit.
+	MaxInFlight int
+	MaxQueue    int
+
+	// ExemptPaths lists request paths that are never killed when Timeout
+	// expires, such as long-running profiling endpoints. Connections
+	// serving them are waited for regardless of Timeout. Paths ending in a
+	// slash exempt all paths below them.
+	ExemptPaths []string
+
+	// KillIdempotentOnly spares connections serving requests that may
+	// modify state, i.e. with a method other than GET, HEAD, OPTIONS or
+	// TRACE, from being killed when Timeout expires, so that they are
+	// never interrupted halfway. Shutdown waits for them regardless of
+	// Timeout, like for ExemptPaths.
+	KillIdempotentOnly bool
+
+	// HandshakeGrace gives TLS connections that have not completed their
+	// first request when shutdown begins, typically because they are still
+	// in the middle of the TLS handshake, this long to do so before they
+	// are closed. Without it they are closed right away along with the
+	// idle connections.
+	HandshakeGrace time.Duration
+
+	// ListenerCloseDelay, if set, keeps the listener open and accepting
+	// all connections this long after shutdown begins, e.g. to let load
+	// balancers notice the server is draining and stop sending it new
+	// connections. Only then is the listener closed and are connections
+	// drained for up to Timeout, after which they are killed.
+	ListenerCloseDelay time.Duration
+
+	// DrainAcceptGrace, if set, keeps the listener open this long after
+	// shutdown begins, or ListenerCloseDelay has passed, before the drain
+	// proper starts, while accepting only connections from DrainAllowlist,
+	// e.g. internal health checkers and admin tools, and closing all
+	// others right away.
+	DrainAcceptGrace time.Duration
+	DrainAllowlist   []net.IPNet
+
+	// AcceptIdleWarn, if set, logs a debug note when no connection has
+	// been accepted for this long, which is normal for a quiet server, and
+	// a warning when accepting has kept failing with the same error for
+	// this long, which points at a stalled accept loop.
+	AcceptIdleWarn time.Duration
+
+	// ManagerHeartbeat, if set, makes the goroutine tracking connections
+	// wake up at this interval even when idle, so that LastManagerTick can
+	// be used to detect it stalling.
+	ManagerHeartbeat time.Duration
+
+	// ReadyCheck, if set, is called by Serve before accepting connections,
+	// e.g. to make sure the server's dependencies are reachable. It is
+	// retried until it succeeds or ReadyCheckTimeout expires, in which case
+	// Serve returns an error. Meanwhile clients are queued by the listener.
+	ReadyCheck func() error
+
+	// ReadyCheckTimeout limits how long Serve waits for ReadyCheck to
+	// succeed. If it is zero, ReadyCheck is retried indefinitely.
+	ReadyCheckTimeout time.Duration
+
+	// StdErrServerClosed makes Serve, and so ListenAndServe, return
+	// http.ErrServerClosed after an intentional shutdown, like
+	// http.Server does, rather than nil. Errors that occurred while
+	// shutting down, such as ErrConnectionsLingering, are still returned
+	// instead.
+	StdErrServerClosed bool
+
+	// BackgroundDrain makes Serve return as soon as the listener is closed
+	// instead of blocking until all connections have drained. The drain
+	// continues in the background; StopChan is closed once it completes.
+	BackgroundDrain bool
+
+	// HandlerFactory, if set, builds a new Handler on SIGHUP, on Unix, or
+	// when ReloadHandler is called, e.g. after reloading routing
+	// configuration. New requests are served by the new handler while
+	// requests in flight finish with the old one. If it fails, the current
+	// handler is kept.
+	HandlerFactory func() (http.Handler, error)
+
+	// OnHandlerRetired, if set, is called in its own goroutine with a
+	// handler replaced by ReloadHandler or WarmReload once the requests it
+	// was serving have all finished.
+	OnHandlerRetired func(old http.Handler)
+
+	// OnPause and OnResume, if set, are called when the server actually
+	// stops and starts serving new connections again because of
+	// PauseAccept and ResumeAccept, marking the start and end of each pause
+	// window. Pauses that end before any connection arrives are not
+	// reported.
+	OnPause  func()
+	OnResume func()
+
+	// DrainRequests, if set, keeps the server serving, listener included,
+	// after shutdown begins until this many more requests have completed,
+	// e.g. to let a batch of jobs finish, before draining the connections.
+	// Both together are bounded by Timeout.
+	DrainRequests int
+
+	// DrainComplete, if set, gates the completion of the drain on the
+	// application's own notion of being busy, e.g. background work tied
+	// to pooled connections that are idle at the TCP level. Once the
+	// connections are gone, it is polled every 100ms until it returns true
+	// or Timeout expires.
+	DrainComplete func() bool
+
+	// PollDrain, if set, makes the drain also check the tracked
+	// connections at this interval and complete once none are left, rather
+	// than relying solely on the removal of the last connection being
+	// reported. Connections graceful closed itself while draining count as
+	// gone even if their removal was never reported.
+	PollDrain time.Duration
+
+	// MaxConnLifetime, if set, recycles connections older than this,
+	// however active, e.g. so that they don't pin stale TLS sessions. They
+	// are closed once they are idle, after finishing the request they are
+	// serving, if any, within a second of outliving it.
+	MaxConnLifetime time.Duration
+
+	// KillRate, if set, limits how many connections per second are closed
+	// when Timeout expires, spreading out the load of closing them and the
+	// clients reconnecting elsewhere. Shutdown completes once all of them
+	// have been closed.
+	KillRate int
+
+	// KillOrder determines which connections KillRate closes first. It
+	// defaults to KillRandom.
+	KillOrder KillOrder
+
+	// MaxConcurrentCloses, if set, closes the connections killed when
+	// Timeout expires in the background, at most this many at a time,
+	// bounding the burst of work a forced shutdown causes, since closes may
+	// block, e.g. to send a TLS close_notify. It applies independently of
+	// KillRate. CloseConn and OnCloseError may then be called concurrently.
+	MaxConcurrentCloses int
+
+	// PostKillGrace, if set, bounds how long shutdown waits for the
+	// connections to go away after killing them when Timeout expires, e.g.
+	// for connections spared by ExemptPaths. If they are still around
+	// afterwards, Serve returns ErrConnectionsLingering regardless.
+	PostKillGrace time.Duration
+
+	// MinDrainTime is the minimum time between the start of shutdown and
+	// Serve returning, even if all connections finish sooner. The listener
+	// is closed meanwhile. It gives external systems such as load
+	// balancers time to stop routing clients to the server before the
+	// process exits.
+	MinDrainTime time.Duration
+
+	// PidFile, if set, is a path the process ID is written to when Serve
+	// starts, replacing any stale file. It is removed when Serve returns,
+	// whether after shutting down or because of an error, unless another
+	// process has taken it over meanwhile.
+	PidFile string
+
+	// ShutdownFile, if set, is a path that is watched while serving. When
+	// a file is created there, or an existing one is modified, it is
+	// removed and a graceful shutdown is triggered as if Stop(Timeout) had
+	// been called. It is an alternative to signals where they are awkward
+	// to send.
+	ShutdownFile string
+
+	// MemoryLimit, if set, triggers a graceful shutdown, as if
+	// Stop(Timeout) had been called, once the heap has stayed larger than
+	// this many bytes for MemoryLimitDuration, so that a leaking server
+	// restarts cleanly rather than being killed for running out of memory.
+	// The heap is checked every second.
+	MemoryLimit         uint64
+	MemoryLimitDuration time.Duration
+
+	// ChildProcesses, if set, supplies the worker processes the server has
+	// spawned. At shutdown each is sent SIGTERM, and Serve waits for them
+	// to exit alongside the drain, for up to Timeout if positive. Graceful
+	// never waits on them: the application must still do so, e.g. with
+	// exec.Cmd.Wait, and a process counts as exited once it has. Where
+	// there is no SIGTERM, as on Windows, they are killed instead and
+	// Serve doesn't wait for them.
+	ChildProcesses func() []*os.Process
+
+	// Cancels lists channels that each trigger a graceful shutdown, as if
+	// Stop(Timeout) had been called, when they are closed or receive a
+	// value. This lets independent subsystems request shutdown without
+	// fanning their channels in first. Unlike signals they never escalate
+	// a shutdown in progress, and a signal arriving shortly after one of
+	// them triggered shutdown doesn't either.
+	Cancels []<-chan struct{}
+
+	// TimedCancel, if set, triggers a graceful shutdown like Cancels when
+	// it receives a duration, which is used as Timeout for that shutdown,
+	// e.g. the remaining grace period granted by an external controller.
+	// It takes precedence over TimeoutFunc and TriggerTimeouts.
+	// Durations received while already shutting down shorten the drain if
+	// they are sooner than its deadline.
+	TimedCancel chan time.Duration
+
+	// ExportExpvar publishes the server's connection counters and the
+	// duration of its last shutdown as an expvar map named ExpvarName, or
+	// "graceful" if that is empty, for viewing at /debug/vars.
+	ExportExpvar bool
+	ExpvarName   string
+
+	// Tracer, if set, records the phases of shutdown as spans.
+	Tracer Tracer
+
+	// AdminServer, if set, is served alongside on its own listener at its
+	// Addr, e.g. for health checks and metrics. It keeps serving while the
+	// main server drains and is only shut down once the drain completes,
+	// allowing its own requests up to Timeout to finish. Serve returns an
+	// error if its Addr can't be listened on.
+	AdminServer *http.Server
+
+	// ControlSocket, if set, is the path of a Unix socket on which Serve
+	// listens for out-of-band commands, e.g. from a command-line tool, one
+	// per line: ControlStatus, ControlDrain and ControlForceStop. Each is
+	// answered with a line. The socket is only accessible to the user the
+	// process runs as, and is closed once shutdown completes. A socket
+	// left behind by a process that exited without closing it is
+	// replaced. Serve returns an error if it can't be listened on, or
+	// ErrControlSocketInUse if another process listens on it.
+	ControlSocket string
+
+	// ShutdownWebhook, if set, is a URL graceful POSTs a small JSON
+	// object to when shutdown begins and when it completes, with the
+	// event ("draining" or "stopped"), the Name, the number of open and
+	// killed connections and the seconds since shutdown began, e.g. to
+	// notify incident tooling. Delivery is best effort and failures are
+	// logged: the drain doesn't wait for the first request, and Serve
+	// returns at most a couple of seconds after the second was sent.
+	ShutdownWebhook string
+
+	// Name, if set, identifies the server in its log lines and events when
+	// several Servers run in one process. With the default Logger lines
+	// are prefixed with "[graceful:Name] ".
+	Name string
+
 	// Logger used to notify of errors on startup and on stop.
 	Logger *log.Logger
 
@@ -62,6 +436,15 @@ type Server struct {
 	// you to use whatever logging approach you would like
 	LogFunc func(format string, args ...interface{})
 
+	// StructuredLogger, if set, receives all of graceful's log messages
+	// with their level and fields instead of Logger and LogFunc, for
+	// logging stacks that expect structured, e.g. JSON, output.
+	StructuredLogger StructuredLogger
+
+	// LogDebug, if set, also writes debug messages to Logger and LogFunc.
+	// StructuredLogger receives them regardless, at LevelDebug.
+	LogDebug bool
+
 	// Interrupted is true if the server is handling a SIGINT or SIGTERM
 	// signal and is thus shutting down.
 	Interrupted bool
@@ -70,6 +453,31 @@ type Server struct {
 	// and the server to shut down.
 	interrupt chan os.Signal
 
+	// trace is the span of the shutdown in progress.
+	trace *shutdownTrace
+
+	// restartListener is the listener RestartWithExec passes on.
+	restartListener net.Listener
+
+	// multi is the listener of ServeMultiple, if serving several.
+	multi *multiListener
+
+	// listenerDrains carries DrainListener's requests to the connection
+	// manager.
+	listenerDrains chan listenerDrain
+
+	// hurry asks the running drain to complete sooner; see expedite.
+	hurry chan time.Duration
+
+	// control is the listener on ControlSocket.
+	control net.Listener
+
+	// gcTuning is what TuneGCOnShutdown changed.
+	gcTuning gcTuning
+
+	// barriers are the drain barriers registered by RegisterDrainBarrier.
+	barriers barriers
+
 	// stopLock is used to protect against concurrent calls to Stop
 	stopLock sync.Mutex
 
@@ -77,16 +485,175 @@ type Server struct {
 	// the server to stop.
 	stopChan chan struct{}
 
+	// served is closed once the server has fully stopped, and serveErr is
+	// then what Serve returned, as reported by Wait.
+	served   chan struct{}
+	serveErr error
+
 	// chanLock is used to protect access to the various channel constructors.
 	chanLock sync.RWMutex
 
-	// connections holds all connections managed by graceful
-	connections map[net.Conn]struct{}
+	// swapLock serializes replacing the handler serving new requests.
+	swapLock sync.Mutex
+
+	// shutdownResult is the outcome reported by Shutdown.Result.
+	shutdownResult shutdownResult
+
+	// trigger names what initiated the last shutdown, as in
+	// TriggerTimeouts. If timed is set, the trigger asked for timeout.
+	trigger string
+	timed   bool
+	timeout time.Duration
+
+	// events is the channel returned by Events.
+	events chan Event
+
+	// stats is the bookkeeping reported by Snapshot.
+	stats stats
+
+	// overload is the load shedding state set by SetOverload.
+	overload overload
+
+	// pause is the accept pausing state set by PauseAccept.
+	pause pause
+
+	// keepAlives is the keep-alive state set by SetKeepAlives.
+	keepAlives keepAlives
+
+	// streams are the responses tracked by FlushMiddleware.
+	streams streams
+
+	// connCancels cancels the contexts of connections that are killed.
+	connCancels connCancels
+
+	// connRecords keeps the state reported by ConnInfoFromContext.
+	connRecords connRecords
+
+	// connQuota counts the connections of each remote IP.
+	connQuota connQuota
+
+	// managerTick holds the time.Time at which the connection manager
+	// last processed an event.
+	managerTick atomic.Value
+
+	// managing is 1 while the connection manager is running.
+	managing int32
+
+	// killed counts the connections killed by the current shutdown.
+	killed int32
+
+	// allowlisting is 1 once only connections from DrainAllowlist are
+	// accepted.
+	allowlisting int32
+
+	// managed is closed once the connection manager has exited.
+	managed chan struct{}
+
+	// tracked is the channel IsTracked queries the connection manager on.
+	tracked chan trackQuery
+
+	// connections holds all connections managed by graceful, with the
+	// time at which each was accepted.
+	connections map[net.Conn]time.Time
 
 	// idleConnections holds all idle connections managed by graceful
 	idleConnections map[net.Conn]struct{}
+
+	// newConnections holds the connections that have not become active yet
+	newConnections map[net.Conn]struct{}
+
+	// requests holds the requests each connection is currently serving
+	requests map[net.Conn]map[*request]struct{}
+
+	// tracker holds the *requestTracker Serve installs as the
+	// http.Server's Handler, which wraps the user's handler.
+	tracker atomic.Value
+}
+
+// ShutdownMode determines how the server shuts down in response to a signal.
+type ShutdownMode int
+
+const (
+	// Graceful closes the listener and waits up to Timeout for active
+	// requests to finish before closing their connections.
+	Graceful ShutdownMode = iota
+
+	// Immediate closes the listener and all connections right away.
+	Immediate
+)
+
+// CloseReason tells why a connection went away.
+type CloseReason int
+
+const (
+	// CloseServing is the reason for connections closed while serving,
+	// e.g. by the client or because of an idle timeout.
+	CloseServing CloseReason = iota
+
+	// CloseDrained is the reason for connections closed while draining,
+	// typically after finishing their requests.
+	CloseDrained
+
+	// CloseIdle is the reason for connections closed by graceful when
+	// shutdown began because they were idle.
+	CloseIdle
+
+	// CloseKilled is the reason for connections killed by graceful because
+	// Timeout expired.
+	CloseKilled
+
+	// CloseHijacked is the reason for connections taken over by a handler.
+	CloseHijacked
+
+	// CloseExpired is the reason for connections closed by graceful once
+	// idle because they had outlived MaxConnLifetime.
+	CloseExpired
+)
+
+var closeReasonNames = map[CloseReason]string{
+	CloseServing:  "serving",
+	CloseDrained:  "drained",
+	CloseIdle:     "idle",
+	CloseKilled:   "killed",
+	CloseHijacked: "hijacked",
+	CloseExpired:  "expired",
 }
 
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// stopSignal is sent on the interrupt channel by Stop. It is distinct from
+// the OS signals so that SignalModes never applies to explicit stops.
+type stopSignal struct{}
+
+func (stopSignal) String() string { return TriggerStop }
+func (stopSignal) Signal()        {}
+
+// cancelSignal is sent on the interrupt channel by Cancels and
+// ShutdownFile. Unlike other triggers it never escalates a shutdown that
+// is already in progress, so that it coalesces with a signal arriving at
+// about the same time.
+type cancelSignal struct{}
+
+func (cancelSignal) String() string { return TriggerCancel }
+func (cancelSignal) Signal()        {}
+
+// timedSignal initiates a shutdown with a timeout of its own, which
+// TimeoutFunc and TriggerTimeouts don't override. If cancel is set it
+// coalesces like a cancelSignal.
+type timedSignal struct {
+	trigger string
+	timeout time.Duration
+	cancel  bool
+}
+
+func (s timedSignal) String() string { return s.trigger }
+func (timedSignal) Signal()          {}
+
 // Run serves the http.Handler with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
@@ -101,11 +668,24 @@ func Run(addr string, timeout time.Duration, n http.Handler) {
 
 	if err := srv.ListenAndServe(); err != nil {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
-			srv.logf("%s", err)
+			srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+			runExit(err)
 			os.Exit(1)
 		}
 	}
+	runExit(nil)
+}
+
+// OnExit, if set, is called by Run, RunEnv and ServeAndExit right before
+// they return or exit the program, with the error they are failing with or
+// nil after a clean shutdown, e.g. to flush logs or close databases.
+var OnExit func(err error)
 
+// runExit calls OnExit, if set.
+func runExit(err error) {
+	if OnExit != nil {
+		OnExit(err)
+	}
 }
 
 // RunWithErr is an alternative version of Run function which can return error.
@@ -113,16 +693,92 @@ func Run(addr string, timeout time.Duration, n http.Handler) {
 // Unlike Run this version will not exit the program if an error is encountered but will
 // return it instead.
 func RunWithErr(addr string, timeout time.Duration, n http.Handler) error {
+	return runWithErr(addr, timeout, n)
+}
+
+// runWithErr serves n on addr like RunWithErr, also shutting down once
+// any of cancels is closed.
+func runWithErr(addr string, timeout time.Duration, n http.Handler, cancels ...<-chan struct{}) error {
 	srv := &Server{
 		Timeout:      timeout,
 		TCPKeepAlive: 3 * time.Minute,
 		Server:       &http.Server{Addr: addr, Handler: n},
 		Logger:       DefaultLogger(),
+		Cancels:      cancels,
 	}
 
 	return srv.ListenAndServe()
 }
 
+// RunContext serves the http.Handler on addr until ctx is done or SIGINT or
+// SIGTERM is received, then waits up to timeout for active requests to
+// finish and returns.
+//
+// Unlike Run it never exits the program: it returns nil on a clean shutdown
+// and the underlying error if the server could not be started or failed
+// while serving.
+func RunContext(ctx context.Context, addr string, timeout time.Duration, h http.Handler) error {
+	return runWithErr(addr, timeout, h, ctx.Done())
+}
+
+// ServeUntilSignal serves the http.Handler on addr until SIGINT or SIGTERM is
+// received, then waits for active requests to finish and returns.
+//
+// It is intended to be the last call in main. Unlike Run it never exits the
+// program: it returns nil on a clean shutdown and the underlying error if the
+// server could not be started or failed while serving.
+func ServeUntilSignal(addr string, timeout time.Duration, h http.Handler) error {
+	return runWithErr(addr, timeout, h)
+}
+
+// NotifyAll registers a single handler for SIGINT and SIGTERM that forwards
+// each signal to all of the servers, in the order given, so that several
+// Servers in one process shut down together. It disables the servers' own
+// signal handling and must be called before they start serving. Servers
+// with a HandlerFactory still reload it on SIGHUP, on Unix.
+func NotifyAll(servers ...*Server) {
+	for _, srv := range servers {
+		srv.NoSignalHandling = true
+	}
+	signals := make(chan os.Signal, 1)
+	signalNotify(signals)
+	go forwardSignals(signals, servers)
+	reload := make(chan os.Signal, 1)
+	signalNotifyReload(reload)
+	go forwardReloads(reload, servers)
+}
+
+// forwardSignals sends each signal received on signals to the servers. A
+// server with a signal still pending, e.g. because it isn't serving, is
+// skipped rather than holding up the others.
+func forwardSignals(signals <-chan os.Signal, servers []*Server) {
+	for sig := range signals {
+		for _, srv := range servers {
+			select {
+			case srv.interruptChan() <- sig:
+			default:
+			}
+		}
+	}
+}
+
+// forwardReloads reloads the handlers of the serving servers that have a
+// HandlerFactory on each signal received on reload.
+func forwardReloads(reload <-chan os.Signal, servers []*Server) {
+	for range reload {
+		for _, srv := range servers {
+			if srv.HandlerFactory == nil || srv.Snapshot().State != StateServing {
+				continue
+			}
+			if err := srv.ReloadHandler(); err != nil {
+				srv.logw(LevelError, map[string]interface{}{"error": err}, "reloading handler: %s", err)
+				continue
+			}
+			srv.logf("handler reloaded")
+		}
+	}
+}
+
 // ListenAndServe is equivalent to http.Server.ListenAndServe with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
@@ -133,13 +789,15 @@ func ListenAndServe(server *http.Server, timeout time.Duration) error {
 }
 
 // ListenAndServe is equivalent to http.Server.ListenAndServe with graceful shutdown enabled.
+// In a process started by RestartWithExec it serves on the inherited listener
+// instead of binding Addr, if the listener is on Addr.
 func (srv *Server) ListenAndServe() error {
-	// Create the listener so we can control their lifetime
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":http"
+	if err := srv.checkHandler(); err != nil {
+		return err
 	}
-	conn, err := srv.newTCPListener(addr)
+
+	// Create the listener so we can control their lifetime
+	conn, err := srv.newTCPListener(srv.listenAddr(":http"))
 	if err != nil {
 		return err
 	}
@@ -147,6 +805,24 @@ func (srv *Server) ListenAndServe() error {
 	return srv.Serve(conn)
 }
 
+// EffectiveAddr returns the address ListenAndServe, or ListenAndServeTLS if
+// a TLSConfig is set, would listen on, without binding it. An empty Addr
+// defaults to ":http" or ":https" respectively.
+func (srv *Server) EffectiveAddr() string {
+	if srv.TLSConfig != nil {
+		return srv.listenAddr(":https")
+	}
+	return srv.listenAddr(":http")
+}
+
+// listenAddr returns the configured Addr, or defaultAddr if it is empty.
+func (srv *Server) listenAddr(defaultAddr string) string {
+	if srv.Addr == "" {
+		return defaultAddr
+	}
+	return srv.Addr
+}
+
 // ListenAndServeTLS is equivalent to http.Server.ListenAndServeTLS with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
@@ -161,14 +837,11 @@ func ListenAndServeTLS(server *http.Server, certFile, keyFile string, timeout ti
 // listener object directly. When ready, pass it to the Serve method.
 func (srv *Server) ListenTLS(certFile, keyFile string) (net.Listener, error) {
 	// Create the listener ourselves so we can control its lifetime
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":https"
-	}
+	addr := srv.listenAddr(":https")
 
-	config := &tls.Config{}
-	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+	config := srv.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
 	}
 
 	var err error
@@ -218,6 +891,10 @@ func TLSConfigHasHTTP2Enabled(t *tls.Config) bool {
 
 // ListenAndServeTLS is equivalent to http.Server.ListenAndServeTLS with graceful shutdown enabled.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if err := srv.checkHandler(); err != nil {
+		return err
+	}
+
 	l, err := srv.ListenTLS(certFile, keyFile)
 	if err != nil {
 		return err
@@ -229,12 +906,11 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 // ListenAndServeTLSConfig can be used with an existing TLS config and is equivalent to
 // http.Server.ListenAndServeTLS with graceful shutdown enabled,
 func (srv *Server) ListenAndServeTLSConfig(config *tls.Config) error {
-	addr := srv.Addr
-	if addr == "" {
-		addr = ":https"
+	if err := srv.checkHandler(); err != nil {
+		return err
 	}
 
-	conn, err := srv.newTCPListener(addr)
+	conn, err := srv.newTCPListener(srv.listenAddr(":https"))
 	if err != nil {
 		return err
 	}
@@ -245,6 +921,22 @@ func (srv *Server) ListenAndServeTLSConfig(config *tls.Config) error {
 	return srv.Serve(tlsListener)
 }
 
+// FromHTTPServer returns a Server that gracefully shuts down the existing
+// http.Server s, allowing active requests timeout to finish.
+//
+// Since graceful needs the http.Server's ConnState hook for itself, a
+// ConnState set on s is moved to the returned Server's ConnState, where it
+// is still called, and a warning is logged.
+func FromHTTPServer(s *http.Server, timeout time.Duration) *Server {
+	srv := &Server{Timeout: timeout, Server: s, Logger: DefaultLogger()}
+	if s.ConnState != nil {
+		srv.logw(LevelWarn, nil, "http.Server ConnState is set directly, moving it to the graceful Server")
+		srv.ConnState = s.ConnState
+		s.ConnState = nil
+	}
+	return srv
+}
+
 // Serve is equivalent to http.Server.Serve with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
@@ -257,30 +949,171 @@ func Serve(server *http.Server, l net.Listener, timeout time.Duration) error {
 
 // Serve is equivalent to http.Server.Serve with graceful shutdown enabled.
 func (srv *Server) Serve(listener net.Listener) error {
+	return srv.serve(listener, nil, nil)
+}
+
+// ServeUntil is like Serve, but also shuts down gracefully, as if
+// Stop(Timeout) had been called, once any of triggers is closed or receives,
+// e.g. ctx.Done() or a timer's channel, in addition to Cancels and, unless
+// NoSignalHandling is set, the signals.
+func (srv *Server) ServeUntil(listener net.Listener, triggers ...<-chan struct{}) error {
+	return srv.serve(listener, nil, triggers)
+}
+
+// ServeAsync serves on the listener in a new goroutine. The ready channel
+// is closed once the server begins accepting connections, and the error
+// Serve returns is delivered on errc when it does. If Serve fails before
+// accepting, ready is never closed.
+func (srv *Server) ServeAsync(listener net.Listener) (ready <-chan struct{}, errc <-chan error) {
+	readyc := make(chan struct{})
+	errch := make(chan error, 1)
+	go func() {
+		errch <- srv.serve(listener, readyc, nil)
+	}()
+	return readyc, errch
+}
+
+// serve implements Serve, closing ready, if given, once it begins
+// accepting connections. triggers initiate a shutdown like Cancels.
+func (srv *Server) serve(listener net.Listener, ready chan struct{}, triggers []<-chan struct{}) (err error) {
+	background := false
+	defer func() {
+		if !background {
+			srv.setServed(err)
+		}
+	}()
+
+	if srv.PidFile != "" {
+		if err := srv.writePidFile(); err != nil {
+			listener.Close()
+			return err
+		}
+		defer srv.removePidFile()
+	}
+
+	hook, err := srv.claimConnState()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	// Listeners served by ServeMultiple may each have their own handler.
+	multi, _ := listener.(*multiListener)
+	if multi == nil || !multi.handled() {
+		if err := srv.checkHandler(); err != nil {
+			srv.releaseConnState()
+			listener.Close()
+			return err
+		}
+	}
+	if err := srv.waitReady(); err != nil {
+		srv.releaseConnState()
+		listener.Close()
+		return err
+	}
+	if err := srv.startAdmin(); err != nil {
+		srv.releaseConnState()
+		listener.Close()
+		return err
+	}
+	if err := srv.startControl(); err != nil {
+		srv.stopAdmin(-1)
+		srv.releaseConnState()
+		listener.Close()
+		return err
+	}
+
+	// Listeners set up by ListenAndServe and ListenAndServeTLS have been
+	// recorded before being wrapped.
+	if _, ok := listener.(filer); ok {
+		srv.chanLock.Lock()
+		srv.restartListener = listener
+		srv.chanLock.Unlock()
+	}
+	srv.chanLock.Lock()
+	srv.multi = multi
+	srv.chanLock.Unlock()
 
+	if srv.AcceptFunc != nil {
+		listener = acceptFuncListener{listener, srv.AcceptFunc}
+	}
+	if srv.OnAccept != nil {
+		listener = onAcceptListener{listener, srv}
+	}
+	if srv.AcceptIdleWarn > 0 {
+		listener = srv.acceptWatchListener(listener)
+	}
 	if srv.ListenLimit != 0 {
 		listener = LimitListener(listener, srv.ListenLimit)
 	}
+	if srv.DrainAcceptGrace > 0 {
+		listener = drainAllowListener{listener, srv}
+	}
+	listener = srv.acceptTimingListener(listener)
+	listener = srv.pauseListener(listener)
+	if srv.MaxConnsPerIP > 0 {
+		listener = quotaListener{listener, srv}
+	}
+	if multi != nil {
+		listener = originListener{listener, multi}
+	}
+
+	atomic.StoreInt32(&srv.allowlisting, 0)
 
 	// Make our stopchan
 	srv.StopChan()
+	srv.chanLock.Lock()
+	srv.trigger = ""
+	srv.timed = false
+	srv.chanLock.Unlock()
 
 	// Track connection state
 	add := make(chan net.Conn)
 	idle := make(chan net.Conn)
 	active := make(chan net.Conn)
 	remove := make(chan net.Conn)
+	hijacked := make(chan net.Conn)
+	started := make(chan *request)
+	finished := make(chan *request)
+	managed := make(chan struct{})
 
 	srv.Server.ConnState = func(conn net.Conn, state http.ConnState) {
+		srv.connRecords.setState(conn, state)
+		var events chan net.Conn
 		switch state {
 		case http.StateNew:
-			add <- conn
+			srv.connOpened(hook)
+			events = add
 		case http.StateActive:
-			active <- conn
+			events = active
 		case http.StateIdle:
-			idle <- conn
-		case http.StateClosed, http.StateHijacked:
-			remove <- conn
+			events = idle
+		case http.StateClosed:
+			srv.connCancels.cancel(conn)
+			srv.connQuota.release(conn)
+			events = remove
+		case http.StateHijacked:
+			srv.connQuota.release(conn)
+			// The handler keeps using the connection, so its context is
+			// left to net/http.
+			srv.connCancels.take(conn)
+			events = hijacked
+		}
+		// Killed connections may report their state after the manager
+		// has exited.
+		if events != nil {
+			select {
+			case events <- conn:
+			case <-managed:
+			}
+		}
+
+		// This is the connection's last call, so once it is done the
+		// original hook may be restored.
+		if state == http.StateClosed || state == http.StateHijacked {
+			defer srv.connClosed(hook)
+			if multi != nil {
+				defer multi.forget(conn)
+			}
 		}
 
 		srv.stopLock.Lock()
@@ -289,12 +1122,41 @@ func (srv *Server) Serve(listener net.Listener) error {
 		if srv.ConnState != nil {
 			srv.ConnState(conn, state)
 		}
+		if hook.direct != nil {
+			hook.direct(conn, state)
+		}
+	}
+
+	srv.Server.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+		ctx, cancel := context.WithCancel(ctx)
+		srv.connCancels.add(conn, cancel)
+		ctx = context.WithValue(ctx, connContextKey, conn)
+		ctx = context.WithValue(ctx, connRecordContextKey, srv.connRecords.add(conn))
+		if srv.ConnContext != nil {
+			ctx = srv.ConnContext(ctx, conn)
+		}
+		return ctx
 	}
 
 	// Manage open connections
+	draining := make(chan struct{})
 	shutdown := make(chan chan struct{})
 	kill := make(chan struct{})
-	go srv.manageConnections(add, idle, active, remove, shutdown, kill)
+	atomic.StoreInt32(&srv.managing, 1)
+	atomic.StoreInt32(&srv.killed, 0)
+	srv.chanLock.Lock()
+	srv.managed = managed
+	srv.chanLock.Unlock()
+	go func() {
+		defer close(managed)
+		defer atomic.StoreInt32(&srv.managing, 0)
+		srv.manageConnections(add, idle, active, remove, hijacked, started, finished, draining, shutdown, kill)
+	}()
+
+	// Track requests
+	tracker := srv.trackRequests(srv.userHandler(), started, finished, managed)
+	srv.tracker.Store(tracker)
+	srv.Server.Handler = tracker
 
 	interrupt := srv.interruptChan()
 	// Set up the interrupt handler
@@ -302,11 +1164,42 @@ func (srv *Server) Serve(listener net.Listener) error {
 		signalNotify(interrupt)
 	}
 	quitting := make(chan struct{})
-	go srv.handleInterrupt(interrupt, quitting, listener)
+	hurry := make(chan time.Duration, 1)
+	srv.chanLock.Lock()
+	srv.hurry = hurry
+	srv.chanLock.Unlock()
+	go srv.handleInterrupt(interrupt, quitting, hurry, draining, managed, listener)
+	if srv.HandlerFactory != nil && !srv.NoSignalHandling {
+		reload := make(chan os.Signal, 1)
+		signalNotifyReload(reload)
+		go srv.handleReload(reload, quitting)
+	}
+	srv.watchCancels(append(append([]<-chan struct{}{}, srv.Cancels...), triggers...), interrupt, quitting)
+	if srv.TimedCancel != nil {
+		go srv.watchTimedCancel(interrupt, quitting, hurry)
+	}
+	if srv.ShutdownFile != "" {
+		go srv.watchShutdownFile(interrupt, quitting)
+	}
+	if srv.MemoryLimit > 0 {
+		go srv.watchMemory(interrupt, quitting)
+	}
+
+	if srv.ExportExpvar {
+		srv.exportExpvar()
+	}
+	srv.resetKeepAlives()
+	srv.stats.setState(StateServing)
+	srv.stats.setListening(true)
+	srv.publish(Event{Kind: EventStarted})
+	if ready != nil {
+		close(ready)
+	}
 
 	// Serve with graceful listener.
 	// Execution blocks here until listener.Close() is called, above.
-	err := srv.Server.Serve(listener)
+	err = srv.Server.Serve(listener)
+	srv.stats.setListening(false)
 	if err != nil {
 		// If the underlying listening is closed, Serve returns an error
 		// complaining about listening on a closed socket. This is expected, so
@@ -319,9 +1212,162 @@ func (srv *Server) Serve(listener net.Listener) error {
 		}
 	}
 
-	srv.shutdown(shutdown, kill)
+	if srv.BackgroundDrain {
+		background = true
+		err = srv.serverClosed(err, quitting)
+		go func() {
+			serr := srv.shutdown(shutdown, kill, hurry, managed)
+			if serr != nil {
+				srv.logw(LevelError, map[string]interface{}{"error": serr}, "%s", serr)
+			}
+			srv.setServed(err)
+		}()
+		return err
+	}
+
+	if serr := srv.shutdown(shutdown, kill, hurry, managed); err == nil {
+		err = serr
+	}
 
-	return err
+	return srv.serverClosed(err, quitting)
+}
+
+// serverClosed maps a nil err to http.ErrServerClosed after an intentional
+// shutdown if StdErrServerClosed is set.
+func (srv *Server) serverClosed(err error, quitting chan struct{}) error {
+	if err != nil || !srv.StdErrServerClosed {
+		return err
+	}
+	select {
+	case <-quitting:
+		return http.ErrServerClosed
+	default:
+		return nil
+	}
+}
+
+// ErrConnectionsLingering is returned by Serve when connections have not
+// gone away within PostKillGrace of being killed.
+var ErrConnectionsLingering = errors.New("connections may still be lingering after being killed")
+
+// ErrNoHandler is returned by Serve when the http.Server has no Handler
+// and AllowDefaultMux is not set.
+var ErrNoHandler = errors.New("no Handler set; set AllowDefaultMux to serve http.DefaultServeMux")
+
+// checkHandler guards against accidentally serving http.DefaultServeMux.
+func (srv *Server) checkHandler() error {
+	if srv.userHandler() == nil && !srv.AllowDefaultMux {
+		return ErrNoHandler
+	}
+	return nil
+}
+
+// readyCheckInterval is the delay between ReadyCheck attempts.
+const readyCheckInterval = 100 * time.Millisecond
+
+// waitReady retries ReadyCheck until it succeeds or ReadyCheckTimeout
+// expires.
+func (srv *Server) waitReady() error {
+	if srv.ReadyCheck == nil {
+		return nil
+	}
+
+	var expired <-chan time.Time
+	if srv.ReadyCheckTimeout > 0 {
+		expired = time.After(srv.ReadyCheckTimeout)
+	}
+	for {
+		err := srv.ReadyCheck()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-expired:
+			return fmt.Errorf("not ready after %s: %w", srv.ReadyCheckTimeout, err)
+		case <-time.After(readyCheckInterval):
+		}
+	}
+}
+
+// ErrConnStateInUse is returned by Serve when the http.Server's ConnState
+// hook is already installed by another graceful Server that is serving.
+var ErrConnStateInUse = errors.New("http.Server ConnState is already managed by graceful")
+
+// connStateHook is the record of a graceful ConnState hook installed on an
+// http.Server. direct is any ConnState that was set directly on the
+// http.Server beforehand, so it can be called and later restored. open
+// counts the connections that may still call the installed hook.
+type connStateHook struct {
+	direct  func(net.Conn, http.ConnState)
+	serving bool
+	open    int
+}
+
+// connStateHooks records the http.Servers whose ConnState hook is installed
+// by a graceful Server. A hook stays installed until the Server has stopped
+// serving and every connection, including killed ones, has reported that it
+// is closed or hijacked, since their goroutines may still be running it.
+var connStateHooks = struct {
+	sync.Mutex
+	hooks map[*http.Server]*connStateHook
+}{hooks: make(map[*http.Server]*connStateHook)}
+
+// claimConnState marks the http.Server's ConnState hook as owned by srv and
+// returns its record.
+func (srv *Server) claimConnState() (*connStateHook, error) {
+	connStateHooks.Lock()
+	defer connStateHooks.Unlock()
+
+	hook, ok := connStateHooks.hooks[srv.Server]
+	if ok && hook.serving {
+		return nil, ErrConnStateInUse
+	}
+	if !ok {
+		hook = &connStateHook{direct: srv.Server.ConnState}
+		connStateHooks.hooks[srv.Server] = hook
+	}
+	hook.serving = true
+	return hook, nil
+}
+
+// releaseConnState gives up srv's claim on the http.Server's ConnState hook,
+// restoring the original ConnState once no connection can call it anymore.
+func (srv *Server) releaseConnState() {
+	connStateHooks.Lock()
+	defer connStateHooks.Unlock()
+
+	hook, ok := connStateHooks.hooks[srv.Server]
+	if !ok {
+		return
+	}
+	hook.serving = false
+	srv.restoreConnState(hook)
+}
+
+// connOpened records that a connection may call hook until connClosed.
+func (srv *Server) connOpened(hook *connStateHook) {
+	connStateHooks.Lock()
+	defer connStateHooks.Unlock()
+	hook.open++
+}
+
+// connClosed records that a connection has made its last call to hook.
+func (srv *Server) connClosed(hook *connStateHook) {
+	connStateHooks.Lock()
+	defer connStateHooks.Unlock()
+	hook.open--
+	srv.restoreConnState(hook)
+}
+
+// restoreConnState puts back the original ConnState and forgets hook if it
+// is no longer serving and no connection can call it anymore. It must be
+// called with connStateHooks locked.
+func (srv *Server) restoreConnState(hook *connStateHook) {
+	if hook.serving || hook.open > 0 || connStateHooks.hooks[srv.Server] != hook {
+		return
+	}
+	srv.Server.ConnState = hook.direct
+	delete(connStateHooks.hooks, srv.Server)
 }
 
 // Stop instructs the type to halt operations and close
@@ -336,7 +1382,67 @@ func (srv *Server) Stop(timeout time.Duration) {
 	defer srv.stopLock.Unlock()
 
 	srv.Timeout = timeout
-	sendSignalInt(srv.interruptChan())
+	srv.interruptChan() <- stopSignal{}
+}
+
+// drainCompleteInterval is how often DrainComplete is polled.
+const drainCompleteInterval = 100 * time.Millisecond
+
+// stopProgressInterval is how often StopAndWait reports progress.
+const stopProgressInterval = time.Second
+
+// StopAndWait stops the server, waiting indefinitely for connections to
+// finish until ctx is done, at which point the remaining ones are killed.
+// If progress is not nil it is called right away and then periodically
+// with the number of connections left. It returns ctx.Err() if the
+// connections had to be killed. TimeoutFunc and TriggerTimeouts don't
+// apply, as ctx alone limits the drain.
+func (srv *Server) StopAndWait(ctx context.Context, progress func(remaining int)) error {
+	srv.stopLock.Lock()
+	srv.interruptChan() <- timedSignal{trigger: TriggerStopAndWait}
+	srv.stopLock.Unlock()
+	stopped := srv.StopChan()
+
+	ticker := time.NewTicker(stopProgressInterval)
+	defer ticker.Stop()
+	if progress != nil {
+		progress(srv.Snapshot().Connections)
+	}
+	for {
+		select {
+		case <-stopped:
+			return nil
+		case <-ticker.C:
+			if progress != nil {
+				progress(srv.Snapshot().Connections)
+			}
+		case <-ctx.Done():
+			srv.chanLock.RLock()
+			hurry := srv.hurry
+			srv.chanLock.RUnlock()
+			if hurry != nil {
+				expedite(hurry, 0)
+				<-stopped
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// ExtendDeadline pushes the write deadline of conn d into the future. It
+// allows handlers streaming long responses to outlive the http.Server's
+// WriteTimeout. The connection serving a request can be obtained with
+// ConnFromContext(r.Context()).
+//
+// If d is zero the write deadline is removed altogether.
+func (srv *Server) ExtendDeadline(conn net.Conn, d time.Duration) {
+	var deadline time.Time
+	if d != 0 {
+		deadline = time.Now().Add(d)
+	}
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+	}
 }
 
 // StopChan gets the stop channel which will block until
@@ -358,28 +1464,197 @@ func DefaultLogger() *log.Logger {
 	return log.New(os.Stderr, "[graceful] ", 0)
 }
 
-func (srv *Server) manageConnections(add, idle, active, remove chan net.Conn, shutdown chan chan struct{}, kill chan struct{}) {
+func (srv *Server) manageConnections(add, idle, active, remove, hijacked chan net.Conn, started, finished chan *request, draining chan struct{}, shutdown chan chan struct{}, kill chan struct{}) {
 	var done chan struct{}
-	srv.connections = map[net.Conn]struct{}{}
+	srv.connections = map[net.Conn]time.Time{}
 	srv.idleConnections = map[net.Conn]struct{}{}
+	srv.newConnections = map[net.Conn]struct{}{}
+	srv.requests = map[net.Conn]map[*request]struct{}{}
+
+	defer srv.recordConnStates()
+
+	var handshakeExpired <-chan time.Time
+	var poll <-chan time.Time
+	// closed holds the connections closed here while draining.
+	closed := map[net.Conn]struct{}{}
+
+	// killing is closed once connections killed at KillRate are all closed.
+	var killing <-chan struct{}
+	// killedConns holds the connections killed here, which were reported
+	// gone when killed and are ignored when they report their closing.
+	killedConns := map[net.Conn]struct{}{}
+
+	// expired holds the connections closed here for outliving
+	// MaxConnLifetime.
+	expired := map[net.Conn]struct{}{}
+	var sweep <-chan time.Time
+	if srv.MaxConnLifetime > 0 {
+		interval := time.Second
+		if srv.MaxConnLifetime < interval {
+			interval = srv.MaxConnLifetime
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
+	// expire closes the idle conn if it has outlived MaxConnLifetime.
+	expire := func(conn net.Conn) {
+		if srv.MaxConnLifetime <= 0 {
+			return
+		}
+		if _, ok := expired[conn]; ok || time.Since(srv.connections[conn]) < srv.MaxConnLifetime {
+			return
+		}
+		srv.closeConn(conn)
+		expired[conn] = struct{}{}
+	}
+
+	// drainStarted is set once the drain has begun, which is announced on
+	// draining before shutting down closes any connection.
+	var drainStarted bool
+	startDrain := func() {
+		if !drainStarted {
+			drainStarted = true
+			srv.publish(Event{Kind: EventDraining, Remaining: len(srv.connections)})
+		}
+	}
+
+	// untrack forgets a connection that went away for reason and reports
+	// whether the drain is complete.
+	untrack := func(conn net.Conn, reason CloseReason) bool {
+		if _, ok := killedConns[conn]; ok {
+			delete(killedConns, conn)
+			return false
+		}
+		if _, ok := srv.connections[conn]; ok && srv.OnConnClose != nil {
+			srv.OnConnClose(conn, reason)
+		}
+		delete(srv.connections, conn)
+		delete(srv.idleConnections, conn)
+		delete(srv.newConnections, conn)
+		delete(srv.requests, conn)
+		delete(expired, conn)
+		srv.stats.removed(len(srv.connections))
+		srv.publish(Event{Kind: EventConnClosed, Remaining: len(srv.connections)})
+		return done != nil && len(srv.connections) == 0 && killing == nil
+	}
+	// dropKilled forgets a connection that was killed.
+	dropKilled := func(conn net.Conn) {
+		srv.reportKilled(conn)
+		if srv.OnConnClose != nil {
+			srv.OnConnClose(conn, CloseKilled)
+		}
+		delete(srv.connections, conn)
+		delete(srv.idleConnections, conn)
+		delete(srv.newConnections, conn)
+		delete(srv.requests, conn)
+		killedConns[conn] = struct{}{}
+	}
+	tracked := srv.trackChan()
+	listenerDrains := srv.listenerDrainChan()
+
+	var heartbeat <-chan time.Time
+	if srv.ManagerHeartbeat > 0 {
+		ticker := time.NewTicker(srv.ManagerHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
 	for {
+		srv.managerTick.Store(time.Now())
+		srv.recordConnStates()
+
 		select {
+		case <-heartbeat:
+		case q := <-tracked:
+			_, ok := srv.connections[q.conn]
+			q.reply <- ok
+		case q := <-listenerDrains:
+			var victims []net.Conn
+			left := 0
+			for k := range srv.connections {
+				if !q.from(k) {
+					continue
+				}
+				if q.kill && !srv.spared(k) {
+					victims = append(victims, k)
+					continue
+				}
+				if _, ok := srv.idleConnections[k]; ok && !srv.inHandshake(k) {
+					if _, ok := closed[k]; !ok {
+						srv.closeConn(k)
+						closed[k] = struct{}{}
+					}
+				}
+				left++
+			}
+			for _, k := range victims {
+				srv.killConn(k)
+				dropKilled(k)
+			}
+			if len(victims) > 0 {
+				srv.stats.kill(len(victims), len(srv.connections))
+				srv.publish(Event{Kind: EventKilled, Count: len(victims)})
+			}
+			q.reply <- left
+			if done != nil && len(srv.connections) == 0 && killing == nil {
+				done <- struct{}{}
+				return
+			}
 		case conn := <-add:
-			srv.connections[conn] = struct{}{}
+			srv.connections[conn] = time.Now()
 			srv.idleConnections[conn] = struct{}{} // Newly-added connections are considered idle until they become active.
+			srv.newConnections[conn] = struct{}{}
+			srv.stats.added(len(srv.connections))
 		case conn := <-idle:
 			srv.idleConnections[conn] = struct{}{}
+			delete(srv.newConnections, conn)
+			expire(conn)
+		case <-sweep:
+			for k := range srv.idleConnections {
+				expire(k)
+			}
 		case conn := <-active:
 			delete(srv.idleConnections, conn)
+			delete(srv.newConnections, conn)
+		case req := <-started:
+			if srv.requests[req.conn] == nil {
+				srv.requests[req.conn] = map[*request]struct{}{}
+			}
+			srv.requests[req.conn][req] = struct{}{}
+		case req := <-finished:
+			delete(srv.requests[req.conn], req)
+			if len(srv.requests[req.conn]) == 0 {
+				delete(srv.requests, req.conn)
+			}
 		case conn := <-remove:
-			delete(srv.connections, conn)
-			delete(srv.idleConnections, conn)
-			if done != nil && len(srv.connections) == 0 {
+			reason := CloseServing
+			if _, ok := closed[conn]; ok {
+				reason = CloseIdle
+			} else if _, ok := expired[conn]; ok {
+				reason = CloseExpired
+			} else if drainStarted {
+				reason = CloseDrained
+			}
+			if untrack(conn, reason) {
+				done <- struct{}{}
+				return
+			}
+		case conn := <-hijacked:
+			if untrack(conn, CloseHijacked) {
 				done <- struct{}{}
 				return
 			}
+		case <-draining:
+			draining = nil
+			startDrain()
 		case done = <-shutdown:
-			if len(srv.connections) == 0 && len(srv.idleConnections) == 0 {
+			startDrain()
+			// The count is authoritative: ConnState delivers each event
+			// before the connection proceeds, and Serve has returned, so
+			// every connection has been added and none is added later.
+			// Connections still open report their removal afterwards.
+			if len(srv.connections) == 0 {
 				done <- struct{}{}
 				return
 			}
@@ -387,23 +1662,187 @@ func (srv *Server) manageConnections(add, idle, active, remove chan net.Conn, sh
 			// connections, we must close all of them now. this prevents idle
 			// connections from holding the server open while waiting for them to
 			// hit their idle timeout.
+			spared := false
 			for k := range srv.idleConnections {
-				if err := k.Close(); err != nil {
-					srv.logf("[ERROR] %s", err)
+				if srv.inHandshake(k) {
+					spared = true
+					continue
 				}
+				srv.closeConn(k)
+				closed[k] = struct{}{}
+			}
+			if spared {
+				handshakeExpired = time.After(srv.HandshakeGrace)
+			}
+			if srv.PollDrain > 0 {
+				ticker := time.NewTicker(srv.PollDrain)
+				defer ticker.Stop()
+				poll = ticker.C
+			}
+		case <-poll:
+			// Connections closed here are gone even if their removal
+			// was never reported.
+			for k := range closed {
+				delete(srv.connections, k)
+				delete(srv.idleConnections, k)
+				delete(srv.newConnections, k)
+				delete(srv.requests, k)
+			}
+			if len(srv.connections) == 0 && killing == nil {
+				done <- struct{}{}
+				return
+			}
+		case <-handshakeExpired:
+			for k := range srv.newConnections {
+				srv.closeConn(k)
+				closed[k] = struct{}{}
 			}
 		case <-kill:
-			srv.stopLock.Lock()
-			defer srv.stopLock.Unlock()
+			kill = nil
 
-			srv.Server.ConnState = nil
+			var victims []net.Conn
 			for k := range srv.connections {
-				if err := k.Close(); err != nil {
-					srv.logf("[ERROR] %s", err)
+				if !srv.spared(k) {
+					victims = append(victims, k)
 				}
 			}
-			return
+			if srv.KillRate > 0 || srv.MaxConcurrentCloses > 0 {
+				srv.orderKill(victims)
+				killing = srv.paceKill(victims)
+			}
+			for _, k := range victims {
+				if killing == nil {
+					srv.killConn(k)
+				}
+				dropKilled(k)
+			}
+			atomic.AddInt32(&srv.killed, int32(len(victims)))
+			srv.stats.kill(len(victims), len(srv.connections))
+			srv.publish(Event{Kind: EventKilled, Count: len(victims)})
+			if len(srv.connections) == 0 && killing == nil {
+				done <- struct{}{}
+				return
+			}
+		case <-killing:
+			killing = nil
+			if len(srv.connections) == 0 {
+				done <- struct{}{}
+				return
+			}
+		}
+	}
+}
+
+// paceKill closes conns in the background, at KillRate per second if set,
+// with at most MaxConcurrentCloses of them being closed at once, or one if
+// it isn't set. The returned channel is closed once they are all closed.
+func (srv *Server) paceKill(conns []net.Conn) <-chan struct{} {
+	workers := srv.MaxConcurrentCloses
+	if workers <= 0 {
+		workers = 1
+	}
+	if workers > len(conns) {
+		workers = len(conns)
+	}
+	queue := make(chan net.Conn)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for conn := range queue {
+				srv.killConn(conn)
+			}
+		}()
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var tick <-chan time.Time
+		if srv.KillRate > 0 {
+			interval := time.Second / time.Duration(srv.KillRate)
+			if interval <= 0 {
+				interval = time.Nanosecond
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i, conn := range conns {
+			if i > 0 && tick != nil {
+				<-tick
+			}
+			queue <- conn
 		}
+		close(queue)
+		wg.Wait()
+	}()
+	return closed
+}
+
+// inHandshake reports whether conn is a new TLS connection that is spared
+// from being closed for HandshakeGrace at shutdown.
+func (srv *Server) inHandshake(conn net.Conn) bool {
+	if srv.HandshakeGrace <= 0 {
+		return false
+	}
+	if _, ok := conn.(*tls.Conn); !ok {
+		return false
+	}
+	_, ok := srv.newConnections[conn]
+	return ok
+}
+
+// recordConnStates updates the per-state connection counts from the
+// connection manager's bookkeeping. New connections are tracked as idle too.
+func (srv *Server) recordConnStates() {
+	newConns := len(srv.newConnections)
+	idleConns := len(srv.idleConnections) - newConns
+	activeConns := len(srv.connections) - len(srv.idleConnections)
+	srv.stats.connStates(newConns, activeConns, idleConns)
+}
+
+// LastManagerTick returns the time at which the goroutine tracking
+// connections last processed an event. It is the zero time before Serve is
+// called. Enable ManagerHeartbeat to have it advance while idle.
+func (srv *Server) LastManagerTick() time.Time {
+	tick, _ := srv.managerTick.Load().(time.Time)
+	return tick
+}
+
+// ManagerRunning reports whether the goroutine tracking connections is
+// running. It exits once shutdown has seen all connections go away.
+func (srv *Server) ManagerRunning() bool {
+	return atomic.LoadInt32(&srv.managing) == 1
+}
+
+// closeConn closes conn on behalf of the shutdown process, reporting any
+// failure to OnCloseError.
+func (srv *Server) closeConn(conn net.Conn) {
+	if err := conn.Close(); err != nil {
+		srv.closeFailed(conn, err)
+	}
+}
+
+// closeFailed reports the failure to close conn.
+func (srv *Server) closeFailed(conn net.Conn, err error) {
+	srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+	if srv.OnCloseError != nil {
+		srv.OnCloseError(conn, err)
+	}
+}
+
+// killConn cancels the context of conn, aborting the work of its handlers,
+// before closing it with CloseConn, if set.
+func (srv *Server) killConn(conn net.Conn) {
+	srv.connCancels.cancel(conn)
+	if srv.CloseConn == nil {
+		srv.closeConn(conn)
+		return
+	}
+	if err := srv.CloseConn(conn); err != nil {
+		srv.closeFailed(conn, err)
 	}
 }
 
@@ -418,69 +1857,569 @@ func (srv *Server) interruptChan() chan os.Signal {
 	return srv.interrupt
 }
 
-func (srv *Server) handleInterrupt(interrupt chan os.Signal, quitting chan struct{}, listener net.Listener) {
-	for _ = range interrupt {
+// coalesceWindow is how long after a cancelSignal initiated shutdown other
+// triggers are taken to be part of the same shutdown request.
+const coalesceWindow = 500 * time.Millisecond
+
+func (srv *Server) handleInterrupt(interrupt chan os.Signal, quitting chan struct{}, hurry chan time.Duration, draining chan struct{}, managed chan struct{}, listener net.Listener) {
+	escalations := 0
+	// cancelled is when a cancelSignal initiated the shutdown.
+	var cancelled time.Time
+	for sig := range interrupt {
+		if srv.SignalModes[sig] == Immediate {
+			expedite(hurry, 0)
+		}
+		_, cancel := sig.(cancelSignal)
+		timed, isTimed := sig.(timedSignal)
+		cancel = cancel || timed.cancel
 		if srv.Interrupted {
+			// Triggers arriving at about the same time coalesce into a
+			// single shutdown rather than escalating it.
+			if cancel || time.Since(cancelled) < coalesceWindow {
+				continue
+			}
+			if escalations < len(srv.EscalationTimeouts) {
+				d := srv.EscalationTimeouts[escalations]
+				escalations++
+				srv.logw(LevelWarn, map[string]interface{}{"timeout": d}, "shutdown escalated, killing connections in %s", d)
+				expedite(hurry, d)
+				continue
+			}
 			srv.logf("already shutting down")
 			continue
 		}
-		srv.logf("shutdown initiated")
+		srv.logw(LevelInfo, map[string]interface{}{"trigger": sig.String()}, "shutdown initiated")
 		srv.Interrupted = true
+		cancelled = time.Time{}
+		if cancel {
+			cancelled = time.Now()
+		}
+		ctx, span := srv.startSpan(context.Background(), "graceful.shutdown")
+		var hookCtx context.Context
+		cancelHooks := func() {}
+		if srv.BeforeShutdownContext != nil || srv.ShutdownInitiatedContext != nil {
+			hookCtx, cancelHooks = srv.hookContext(ctx, triggerName(sig), isTimed, timed.timeout)
+		}
+		proceed := true
 		if srv.BeforeShutdown != nil {
-			if !srv.BeforeShutdown() {
-				srv.Interrupted = false
-				continue
+			_, hook := srv.startSpan(ctx, "graceful.before_shutdown")
+			proceed = srv.BeforeShutdown()
+			hook.End()
+		}
+		if proceed && srv.BeforeShutdownContext != nil {
+			_, hook := srv.startSpan(ctx, "graceful.before_shutdown")
+			proceed = srv.BeforeShutdownContext(hookCtx)
+			hook.End()
+		}
+		if !proceed {
+			cancelHooks()
+			span.End()
+			srv.Interrupted = false
+			select {
+			case <-hurry:
+			default:
 			}
+			continue
 		}
-
+		// The hooks may hand their context on to work outliving them, so
+		// it is only cancelled once shutdown has completed.
+		if hookCtx != nil {
+			go func(stopped <-chan struct{}, cancel context.CancelFunc) {
+				<-stopped
+				cancel()
+			}(srv.StopChan(), cancelHooks)
+		}
+		srv.setShutdownTrace(ctx, span)
+		srv.chanLock.Lock()
+		srv.trigger = triggerName(sig)
+		srv.timed, srv.timeout = isTimed, timed.timeout
+		srv.chanLock.Unlock()
+		srv.tuneGC()
+
+		// The manager learns of the drain before disabling keep-alives
+		// closes idle connections, so it reports them as drained after
+		// it.
+		select {
+		case draining <- struct{}{}:
+		case <-managed:
+		}
+		srv.stats.setState(StateDraining)
 		close(quitting)
-		srv.SetKeepAlivesEnabled(false)
-		if err := listener.Close(); err != nil {
-			srv.logf("[ERROR] %s", err)
+		srv.disableKeepAlives()
+		if srv.ListenerCloseDelay > 0 || srv.DrainAcceptGrace > 0 || srv.DrainRequests > 0 {
+			go func() {
+				time.Sleep(srv.ListenerCloseDelay)
+				atomic.StoreInt32(&srv.allowlisting, 1)
+				time.Sleep(srv.DrainAcceptGrace)
+				if srv.DrainRequests > 0 {
+					srv.awaitRequests(hurry)
+				}
+				srv.closeListener(listener)
+			}()
+		} else {
+			srv.closeListener(listener)
 		}
+		srv.flushStreams()
 
 		if srv.ShutdownInitiated != nil {
+			_, hook := srv.startSpan(ctx, "graceful.shutdown_initiated")
 			srv.ShutdownInitiated()
+			hook.End()
+		}
+		if srv.ShutdownInitiatedContext != nil {
+			_, hook := srv.startSpan(ctx, "graceful.shutdown_initiated")
+			srv.ShutdownInitiatedContext(hookCtx)
+			hook.End()
+		}
+	}
+}
+
+// shutdownTimeout returns the timeout of the shutdown that is beginning:
+// the one its trigger asked for, if any, or else from Timeout, TimeoutFunc
+// and TriggerTimeouts.
+func (srv *Server) shutdownTimeout() time.Duration {
+	srv.chanLock.RLock()
+	trigger, timed, timeout := srv.trigger, srv.timed, srv.timeout
+	srv.chanLock.RUnlock()
+	return srv.triggerTimeout(trigger, timed, timeout)
+}
+
+// triggerTimeout returns the timeout of a shutdown initiated by trigger:
+// timeout if the trigger was timed, or else from Timeout, TimeoutFunc and
+// TriggerTimeouts.
+func (srv *Server) triggerTimeout(trigger string, timed bool, timeout time.Duration) time.Duration {
+	if timed {
+		return timeout
+	}
+
+	srv.stopLock.Lock()
+	timeout = srv.Timeout
+	srv.stopLock.Unlock()
+	if srv.TimeoutFunc != nil {
+		timeout = srv.TimeoutFunc(srv.ConnectionCountByState()[http.StateActive])
+	}
+	if d, ok := srv.TriggerTimeouts[trigger]; ok {
+		timeout = d
+	}
+	return timeout
+}
+
+// hookContext returns the context passed to BeforeShutdownContext and
+// ShutdownInitiatedContext for a shutdown initiated by trigger. Its
+// deadline is the earliest the drain may kill the remaining connections,
+// if Timeout limits it.
+func (srv *Server) hookContext(ctx context.Context, trigger string, timed bool, timeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout = srv.triggerTimeout(trigger, timed, timeout)
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return context.WithTimeout(ctx, srv.ListenerCloseDelay+srv.DrainAcceptGrace+timeout)
+}
+
+// closeListener closes listener, which makes Serve return.
+func (srv *Server) closeListener(listener net.Listener) {
+	if err := listener.Close(); err != nil {
+		srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+	}
+	srv.stats.setListening(false)
+}
+
+// watchCancels turns the first receive on any of cancels into a
+// shutdown request. The watching goroutines exit once shutdown begins.
+func (srv *Server) watchCancels(cancels []<-chan struct{}, interrupt chan os.Signal, quitting chan struct{}) {
+	for _, c := range cancels {
+		go func(c <-chan struct{}) {
+			select {
+			case <-c:
+				select {
+				case <-quitting:
+					return
+				default:
+				}
+				select {
+				case interrupt <- cancelSignal{}:
+				case <-quitting:
+				}
+			case <-quitting:
+			}
+		}(c)
+	}
+}
+
+// watchTimedCancel initiates shutdown with the timeout received on
+// TimedCancel, and shortens the drain to later values received while
+// shutting down.
+func (srv *Server) watchTimedCancel(interrupt chan os.Signal, quitting chan struct{}, hurry chan time.Duration) {
+	stopped := srv.StopChan()
+	// A zero Timeout doesn't limit the drain, so it can't shorten it.
+	shorten := func(d time.Duration) {
+		if d != 0 {
+			expedite(hurry, d)
+		}
+	}
+	for {
+		select {
+		case d := <-srv.TimedCancel:
+			select {
+			case <-quitting:
+				shorten(d)
+				continue
+			default:
+			}
+			select {
+			case interrupt <- timedSignal{trigger: TriggerCancel, timeout: d, cancel: true}:
+			case <-quitting:
+				shorten(d)
+			}
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// waitMinDrain keeps the server from stopping until MinDrainTime has passed
+// since shutdown began. A request to hurry up limits the wait accordingly.
+func (srv *Server) waitMinDrain(hurry chan time.Duration) {
+	if srv.MinDrainTime <= 0 {
+		return
+	}
+	left := srv.MinDrainTime - srv.Snapshot().SinceShutdown
+	if left <= 0 {
+		return
+	}
+	end := time.Now().Add(left)
+	expired := time.After(left)
+	for {
+		select {
+		case <-expired:
+			return
+		case d := <-hurry:
+			if d <= 0 {
+				return
+			}
+			if time.Now().Add(d).Before(end) {
+				end = time.Now().Add(d)
+				expired = time.After(d)
+			}
+		}
+	}
+}
+
+// shutdownFileInterval is how often ShutdownFile is checked.
+const shutdownFileInterval = 250 * time.Millisecond
+
+// watchShutdownFile polls ShutdownFile until it is created or modified,
+// then removes it and requests shutdown. It exits once shutdown begins.
+func (srv *Server) watchShutdownFile(interrupt chan os.Signal, quitting chan struct{}) {
+	var modTime time.Time
+	if fi, err := os.Stat(srv.ShutdownFile); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(shutdownFileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-quitting:
+			return
+		}
+		fi, err := os.Stat(srv.ShutdownFile)
+		if err != nil || fi.ModTime().Equal(modTime) {
+			continue
+		}
+		srv.logw(LevelInfo, map[string]interface{}{"file": srv.ShutdownFile}, "shutdown file %s found", srv.ShutdownFile)
+		if err := os.Remove(srv.ShutdownFile); err != nil {
+			srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+		}
+		select {
+		case interrupt <- cancelSignal{}:
+		case <-quitting:
+		}
+		return
+	}
+}
+
+// expedite asks a running drain to complete within d, killing the
+// remaining connections right away if d is zero. A pending request that
+// has not been picked up yet is replaced only by a shorter one.
+func expedite(hurry chan time.Duration, d time.Duration) {
+	for {
+		select {
+		case hurry <- d:
+			return
+		case pending := <-hurry:
+			if pending < d {
+				d = pending
+			}
 		}
 	}
 }
 
 func (srv *Server) logf(format string, args ...interface{}) {
+	srv.logw(LevelInfo, nil, format, args...)
+}
+
+// logw logs a message at level, with fields describing it for the
+// StructuredLogger. Text output only has the formatted message, marked if
+// it is an error, and leaves out debug messages unless LogDebug is set.
+func (srv *Server) logw(level LogLevel, fields map[string]interface{}, format string, args ...interface{}) {
+	if srv.StructuredLogger != nil {
+		all := map[string]interface{}{}
+		for k, v := range fields {
+			all[k] = v
+		}
+		if srv.Name != "" {
+			all["server"] = srv.Name
+		}
+		srv.StructuredLogger.Log(level, fmt.Sprintf(format, args...), all)
+		return
+	}
+
+	if level == LevelDebug && !srv.LogDebug {
+		return
+	}
+	if level == LevelError {
+		format = "[ERROR] " + format
+	}
 	if srv.LogFunc != nil {
+		if srv.Name != "" {
+			format = srv.Name + ": " + format
+		}
 		srv.LogFunc(format, args...)
 	} else if srv.Logger != nil {
-		srv.Logger.Printf(format, args...)
+		srv.logger().Printf(format, args...)
 	}
 }
 
-func (srv *Server) shutdown(shutdown chan chan struct{}, kill chan struct{}) {
-	// Request done notification
-	done := make(chan struct{})
-	shutdown <- done
+// logger returns the Logger, with Name worked into its prefix.
+func (srv *Server) logger() *log.Logger {
+	if srv.Name == "" {
+		return srv.Logger
+	}
+	prefix := srv.Logger.Prefix()
+	if strings.HasSuffix(prefix, "] ") {
+		prefix = strings.TrimSuffix(prefix, "] ") + ":" + srv.Name + "] "
+	} else {
+		prefix += srv.Name + ": "
+	}
+	return log.New(srv.Logger.Writer(), prefix, srv.Logger.Flags())
+}
 
-	srv.stopLock.Lock()
-	defer srv.stopLock.Unlock()
-	if srv.Timeout > 0 {
+func (srv *Server) shutdown(shutdown chan chan struct{}, kill chan struct{}, hurry chan time.Duration, managed chan struct{}) error {
+	srv.stats.setState(StateDraining)
+	srv.notifyWebhook(EventDraining, 0)
+
+	timeout := srv.shutdownTimeout()
+	configured := timeout
+
+	traceCtx, span := srv.takeShutdownTrace()
+	_, drain := srv.startSpan(traceCtx, "graceful.drain")
+
+	ctx, cancel := context.WithCancel(traceCtx)
+	defer cancel()
+
+	// A zero Timeout waits indefinitely, while a negative one allows no
+	// grace period at all.
+	limited := timeout != 0
+	if timeout < 0 {
+		srv.logw(LevelWarn, map[string]interface{}{"timeout": timeout}, "negative timeout %s, killing connections immediately", timeout)
+		timeout = 0
+	}
+
+	var deadline time.Time
+	var expired <-chan time.Time
+	if limited {
+		deadline = time.Now().Add(timeout)
+		expired = time.After(timeout)
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	srv.stats.setDrainDeadline(deadline)
+
+	// Child processes drain alongside the connections.
+	children := srv.stopChildren(configured)
+
+	// requestDone asks the connection manager to notify done once all
+	// connections are gone. Should it have exited already, there are none
+	// left to wait for.
+	var done chan struct{}
+	requestDone := func() {
+		done = make(chan struct{}, 1)
 		select {
-		case <-done:
-		case <-time.After(srv.Timeout):
-			close(kill)
+		case shutdown <- done:
+		case <-managed:
+			done <- struct{}{}
 		}
+	}
+
+	// Request done notification, unless the GracefulStopper gets to shut
+	// down its connections first.
+	stopped := make(chan error, 1)
+	if srv.GracefulStopper != nil {
+		go func() { stopped <- srv.GracefulStopper(ctx) }()
 	} else {
-		<-done
+		requestDone()
+	}
+
+	var killed, lingering bool
+	forceKill := func() {
+		killed = true
+		cancel()
+		if done == nil {
+			requestDone()
+		}
+		_, span := srv.startSpan(traceCtx, "graceful.kill")
+		defer span.End()
+		srv.flushStreams()
+		close(kill)
+
+		var grace <-chan time.Time
+		if srv.PostKillGrace > 0 {
+			grace = time.After(srv.PostKillGrace)
+		}
+		select {
+		case <-done:
+		case <-grace:
+			lingering = true
+		}
+	}
+
+	// Once the connections are gone, DrainComplete, if set, is polled
+	// until it reports that the application is done too.
+	var drained bool
+	var gate <-chan time.Time
+	drainIncomplete := func() {
+		srv.logw(LevelWarn, nil, "drain complete, but DrainComplete still reports the server busy")
+	}
+
+wait:
+	for {
+		select {
+		case err := <-stopped:
+			if err != nil {
+				srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+			}
+			requestDone()
+		case <-done:
+			if srv.DrainComplete == nil || srv.DrainComplete() {
+				break wait
+			}
+			drained = true
+			done = nil
+			ticker := time.NewTicker(drainCompleteInterval)
+			defer ticker.Stop()
+			gate = ticker.C
+		case <-gate:
+			if srv.DrainComplete() {
+				break wait
+			}
+		case <-expired:
+			if drained {
+				drainIncomplete()
+				break wait
+			}
+			forceKill()
+			break wait
+		case d := <-hurry:
+			if d <= 0 {
+				srv.stats.setDrainDeadline(time.Now())
+				if drained {
+					drainIncomplete()
+					break wait
+				}
+				forceKill()
+				break wait
+			}
+			if deadline.IsZero() || time.Now().Add(d).Before(deadline) {
+				deadline = time.Now().Add(d)
+				srv.stats.setDrainDeadline(deadline)
+				expired = time.After(d)
+			}
+		}
+	}
+	srv.waitBarriers(deadline)
+	srv.waitMinDrain(hurry)
+	drain.End()
+
+	// Killed connections may still be running the installed hooks, so
+	// the ConnState hook is restored once the last of them is done, and
+	// the handler only after a clean drain.
+	srv.releaseConnState()
+	if !killed {
+		srv.Server.Handler = srv.tracker.Load().(*requestTracker).handler()
+	}
+
+	// The admin server outlives the drain so it can be scraped meanwhile.
+	srv.stopAdmin(configured)
+	srv.stopControl()
+	srv.restoreGC()
+
+	<-children
+
+	srv.stats.setState(StateStopped)
+	span.End()
+	srv.publish(Event{Kind: EventStopped})
+
+	var err error
+	if lingering {
+		err = ErrConnectionsLingering
 	}
+	result := shutdownResult{err: err, timedOut: killed, killed: int(atomic.LoadInt32(&srv.killed))}
+	<-srv.notifyWebhook(EventStopped, result.killed)
+
 	// Close the stopChan to wake up any blocked goroutines.
 	srv.chanLock.Lock()
+	srv.shutdownResult = result
 	if srv.stopChan != nil {
 		close(srv.stopChan)
 	}
 	srv.chanLock.Unlock()
+
+	return err
 }
 
-func (srv *Server) newTCPListener(addr string) (net.Listener, error) {
-	conn, err := net.Listen("tcp", addr)
+// bindTCP listens on addr for newTCPListener, with ListenBacklog if set.
+func (srv *Server) bindTCP(addr string) (net.Listener, error) {
+	var conn net.Listener
+	var err error
+	if srv.ListenBacklog > 0 {
+		conn, err = listenBacklog(addr, srv.ListenBacklog)
+	} else {
+		conn, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
-		return conn, err
+		return nil, err
+	}
+	srv.setRestartListener(conn)
+	return conn, nil
+}
+
+// setRestartListener records conn as the listener RestartWithExec passes
+// on.
+func (srv *Server) setRestartListener(conn net.Listener) {
+	srv.chanLock.Lock()
+	srv.restartListener = conn
+	srv.chanLock.Unlock()
+}
+
+func (srv *Server) newTCPListener(addr string) (net.Listener, error) {
+	// An inherited listener keeps the backlog it was listening with.
+	conn, ok := inheritListener(addr)
+	if ok {
+		srv.setRestartListener(conn)
+	} else {
+		var err error
+		conn, err = srv.bindTCP(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if srv.RebindOnFailure > 0 {
+		conn = srv.rebindListener(conn)
 	}
 	if srv.TCPKeepAlive != 0 {
 		conn = keepAliveListener{conn, srv.TCPKeepAlive}
@@ -2,16 +2,22 @@ package graceful
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -480,6 +486,44 @@ func TestBeforeShutdownCanceled(t *testing.T) {
 	wg.Wait()
 }
 
+func TestShutdownHooksContext(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadlines := make(chan time.Time, 2)
+	record := func(ctx context.Context) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Error("expected the hook context to have a deadline")
+		}
+		deadlines <- deadline
+	}
+	srv := &Server{
+		Server:                   server,
+		NoSignalHandling:         true,
+		BeforeShutdownContext:    func(ctx context.Context) bool { record(ctx); return true },
+		ShutdownInitiatedContext: record,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(killTime)
+	for i := 0; i < 2; i++ {
+		select {
+		case deadline := <-deadlines:
+			if d := deadline.Sub(start); d < killTime-waitTime || d > killTime+waitTime {
+				t.Errorf("expected the hook deadline about %s after shutdown began, got %s", killTime, d)
+			}
+		case <-time.After(killTime):
+			t.Fatal("expected both hooks to be called")
+		}
+	}
+	<-srv.StopChan()
+}
+
 func hijackingListener(srv *Server) (*http.Server, net.Listener, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
@@ -690,3 +734,1401 @@ func (buf *SyncBuffer) Write(b []byte) (int, error) {
 	defer buf.Done()
 	return buf.Buffer.Write(b)
 }
+
+func TestBackgroundDrain(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: 0, Server: server, BackgroundDrain: true, interrupt: c}
+	served := make(chan struct{})
+	go func() {
+		srv.Serve(l)
+		close(served)
+	}()
+	time.Sleep(waitTime)
+
+	requested := make(chan struct{})
+	go func() {
+		defer close(requested)
+		if _, err := http.Get(fmt.Sprintf("http://localhost:%d", port)); err != nil {
+			t.Errorf("Get failed: %v", err)
+		}
+	}()
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+
+	select {
+	case <-served:
+	case <-time.After(killTime / 2):
+		t.Fatal("Serve should return before the drain completes")
+	}
+
+	select {
+	case <-srv.StopChan():
+		t.Fatal("StopChan closed before the in-flight request finished")
+	default:
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for background drain to complete")
+	}
+	<-requested
+}
+
+func TestServeUntilSignalBindError(t *testing.T) {
+	_, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if err := ServeUntilSignal(fmt.Sprintf(":%d", port), killTime, http.NotFoundHandler()); err == nil {
+		t.Fatal("expected an error when the address is already in use")
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- RunContext(ctx, fmt.Sprintf("localhost:%d", port), killTime, http.NotFoundHandler()) }()
+	time.Sleep(waitTime)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("expected RunContext to return once ctx was cancelled")
+	}
+}
+
+func TestExtendDeadline(t *testing.T) {
+	srv := &Server{NoSignalHandling: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		conn, ok := ConnFromContext(r.Context())
+		if !ok {
+			t.Error("expected the connection to be stored in the request context")
+			return
+		}
+		srv.ExtendDeadline(conn, killTime*2)
+		time.Sleep(killTime)
+		rw.Write([]byte("streamed"))
+	})
+	srv.Server = &http.Server{Handler: mux, WriteTimeout: waitTime}
+
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "streamed" {
+		t.Fatalf("expected the full response, got %q (%v)", body, err)
+	}
+}
+
+func TestConnStateAlreadyManaged(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := &Server{Server: server, NoSignalHandling: true}
+	go first.Serve(l)
+	time.Sleep(waitTime)
+
+	l2, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := &Server{Server: server, NoSignalHandling: true}
+	if err := second.Serve(l2); err != ErrConnStateInUse {
+		t.Errorf("expected ErrConnStateInUse, got %v", err)
+	}
+
+	first.Stop(0)
+	<-first.StopChan()
+	if server.ConnState != nil {
+		t.Error("expected the original ConnState to be restored")
+	}
+}
+
+func TestDirectConnStateIsChained(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	var lock sync.Mutex
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+
+	srv.Stop(0)
+	<-srv.StopChan()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if calls == 0 {
+		t.Error("expected the directly set ConnState to be called")
+	}
+}
+
+var errCloseFailed = errors.New("close failed")
+
+// failingCloseListener wraps accepted connections so that closing them
+// reports an error.
+type failingCloseListener struct {
+	net.Listener
+}
+
+func (l failingCloseListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return failingCloseConn{c}, nil
+}
+
+type failingCloseConn struct {
+	net.Conn
+}
+
+func (c failingCloseConn) Close() error {
+	c.Conn.Close()
+	return errCloseFailed
+}
+
+func TestOnCloseError(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var closeErrs []error
+	srv := &Server{
+		Timeout: killTime,
+		Server:  server,
+		OnCloseError: func(conn net.Conn, err error) {
+			lock.Lock()
+			closeErrs = append(closeErrs, err)
+			lock.Unlock()
+		},
+		interrupt: c,
+	}
+	go srv.Serve(failingCloseListener{l})
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	c <- os.Interrupt
+	<-srv.StopChan()
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(closeErrs) != 1 || closeErrs[0] != errCloseFailed {
+		t.Errorf("expected one close error to be reported, got %v", closeErrs)
+	}
+}
+
+func TestSignalModeImmediate(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Timeout:     0,
+		Server:      server,
+		SignalModes: map[os.Signal]ShutdownMode{syscall.SIGTERM: Immediate},
+		interrupt:   c,
+	}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	// A graceful signal waits forever for the request with a zero Timeout,
+	// a subsequent immediate one kills it.
+	c <- os.Interrupt
+	time.Sleep(waitTime)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("graceful shutdown should wait for the active request")
+	default:
+	}
+
+	c <- syscall.SIGTERM
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime):
+		t.Fatal("Timed out while waiting for immediate shutdown")
+	}
+	wg.Wait()
+}
+
+func TestDirectConnStateRestoredAfterKill(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{}, concurrentRequestN)
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+
+	srv := &Server{Timeout: killTime / 2, Server: server, interrupt: c}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	c <- os.Interrupt
+	<-srv.StopChan()
+	wg.Wait()
+
+	// The killed connection reports its closing once its handler returns,
+	// after the manager has exited, which must still reach the directly
+	// set hook.
+	select {
+	case <-closed:
+	case <-time.After(killTime * 10):
+		t.Fatal("expected the directly set ConnState to see the killed connection close")
+	}
+
+	// Once it has, the hook is restored and forgotten.
+	deadline := time.Now().Add(timeoutTime)
+	for {
+		connStateHooks.Lock()
+		_, ok := connStateHooks.hooks[server]
+		connStateHooks.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the ConnState hook to be released")
+		}
+		time.Sleep(waitTime / 10)
+	}
+	server.ConnState(nil, http.StateClosed)
+	select {
+	case <-closed:
+	default:
+		t.Error("expected the directly set ConnState to be restored")
+	}
+}
+
+func TestServeWithoutHandler(t *testing.T) {
+	_, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: &http.Server{}, NoSignalHandling: true}
+	if err := srv.Serve(l); err != ErrNoHandler {
+		t.Fatalf("expected ErrNoHandler, got %v", err)
+	}
+
+	// The listener is closed, so the port may be bound again.
+	_, l, err = createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.AllowDefaultMux = true
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	srv.Stop(0)
+	<-srv.StopChan()
+}
+
+func TestEscalationTimeouts(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Timeout:            0,
+		EscalationTimeouts: []time.Duration{killTime, waitTime},
+		Server:             server,
+		NoSignalHandling:   true,
+	}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(0)
+	time.Sleep(waitTime)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("the first stop should wait for the active request")
+	default:
+	}
+
+	// Each repeated stop shortens the remaining drain.
+	srv.Stop(0)
+	srv.Stop(0)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for escalated shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > killTime {
+		t.Errorf("expected the second escalation to cut the drain short, took %s", elapsed)
+	}
+	wg.Wait()
+}
+
+func TestCoalescedTriggers(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := make(chan struct{})
+	srv := &Server{
+		EscalationTimeouts: []time.Duration{0},
+		Cancels:            []<-chan struct{}{cancel},
+		Server:             server,
+		interrupt:          c,
+	}
+	events := srv.Events()
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, http.StatusOK, false, &wg, &once)
+	time.Sleep(waitTime)
+
+	// A cancel at about the same time as a signal must not escalate the
+	// shutdown and kill the active request.
+	go func() { c <- os.Interrupt }()
+	close(cancel)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for shutdown")
+	}
+	wg.Wait()
+
+	draining := 0
+	for _, e := range collectEvents(events) {
+		if e.Kind == EventDraining {
+			draining++
+		}
+	}
+	if draining != 1 {
+		t.Errorf("expected a single drain, got %d", draining)
+	}
+}
+
+func TestGracefulStopper(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := make(chan struct{})
+	srv := &Server{
+		Timeout: killTime,
+		Server:  server,
+		GracefulStopper: func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("expected the context to carry the drain deadline")
+			}
+			close(called)
+			return nil
+		},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+	select {
+	case <-called:
+	default:
+		t.Fatal("expected GracefulStopper to be called")
+	}
+}
+
+func TestGracefulStopperTimesOut(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled := make(chan struct{})
+	srv := &Server{
+		Server: server,
+		GracefulStopper: func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	srv.Stop(killTime / 2)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(waitTime):
+		t.Fatal("expected the GracefulStopper context to be cancelled")
+	}
+}
+
+func TestNegativeTimeout(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(-1)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime):
+		t.Fatal("expected a negative timeout to kill connections immediately")
+	}
+	if elapsed := time.Since(start); elapsed > killTime/2 {
+		t.Errorf("expected an immediate shutdown, took %s", elapsed)
+	}
+	wg.Wait()
+}
+
+func TestCancels(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := make(chan struct{})
+	second := make(chan struct{})
+	srv := &Server{
+		Server:           server,
+		Cancels:          []<-chan struct{}{first, second},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	close(second)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for a cancel to stop the server")
+	}
+}
+
+func TestServeUntil(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := make(chan struct{})
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeUntil(l, timer, ctx.Done()) }()
+	time.Sleep(waitTime)
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for a trigger to stop the server")
+	}
+	if len(srv.Cancels) != 0 {
+		t.Error("expected the triggers not to be added to Cancels")
+	}
+}
+
+func TestStdErrServerClosed(t *testing.T) {
+	for _, std := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{
+			Server:             &http.Server{Handler: http.NotFoundHandler()},
+			StdErrServerClosed: std,
+			NoSignalHandling:   true,
+		}
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(l) }()
+		time.Sleep(waitTime)
+
+		srv.Stop(0)
+		err = <-served
+		if std && err != http.ErrServerClosed {
+			t.Errorf("expected http.ErrServerClosed, got %v", err)
+		}
+		if !std && err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}
+}
+
+func TestTimedCancel(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The timeout received takes precedence over TimeoutFunc and
+	// TriggerTimeouts, which would both kill the request right away.
+	timedCancel := make(chan time.Duration)
+	srv := &Server{
+		Server:           server,
+		TimedCancel:      timedCancel,
+		TimeoutFunc:      func(int) time.Duration { return -1 },
+		TriggerTimeouts:  map[string]time.Duration{TriggerCancel: -1},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	time.Sleep(waitTime)
+
+	// The request outlasts the timeout received, so it is killed.
+	start := time.Now()
+	timedCancel <- killTime
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime * 5):
+		t.Fatal("Timed out while waiting for the timed cancel to stop the server")
+	}
+	if elapsed := time.Since(start); elapsed < killTime {
+		t.Errorf("expected the drain to last the timeout received, took %s", elapsed)
+	}
+}
+
+func TestTimeoutFunc(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actives := make(chan int, 1)
+	srv := &Server{
+		Server: server,
+		TimeoutFunc: func(active int) time.Duration {
+			actives <- active
+			return killTime * time.Duration(active)
+		},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	time.Sleep(waitTime)
+
+	// The computed timeout overrides the indefinite one passed to Stop.
+	start := time.Now()
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime * 5):
+		t.Fatal("Timed out while waiting for the computed timeout to stop the server")
+	}
+	if elapsed := time.Since(start); elapsed < killTime {
+		t.Errorf("expected the drain to last the computed timeout, took %s", elapsed)
+	}
+	if active := <-actives; active != 1 {
+		t.Errorf("expected 1 active connection, got %d", active)
+	}
+}
+
+func TestTriggerTimeouts(t *testing.T) {
+	for _, sig := range []os.Signal{stopSignal{}, syscall.SIGTERM} {
+		server, l, err := createListener(killTime * 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{
+			Server: server,
+			TriggerTimeouts: map[string]time.Duration{
+				TriggerStop:    killTime,
+				TriggerSIGTERM: killTime,
+			},
+			NoSignalHandling: true,
+		}
+		go srv.Serve(l)
+		time.Sleep(waitTime)
+
+		go http.Get(fmt.Sprintf("http://localhost:%d", port))
+		time.Sleep(waitTime)
+
+		// The trigger's timeout overrides the indefinite Timeout.
+		start := time.Now()
+		srv.interruptChan() <- sig
+		select {
+		case <-srv.StopChan():
+		case <-time.After(killTime * 5):
+			t.Fatalf("%s: timed out while waiting for the trigger's timeout to stop the server", sig)
+		}
+		if elapsed := time.Since(start); elapsed < killTime {
+			t.Errorf("%s: expected the drain to last the trigger's timeout, took %s", sig, elapsed)
+		}
+	}
+}
+
+func TestForwardSignals(t *testing.T) {
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+		go srv.Serve(l)
+		servers = append(servers, srv)
+	}
+	time.Sleep(waitTime)
+
+	signals := make(chan os.Signal, 1)
+	go forwardSignals(signals, servers)
+	signals <- os.Interrupt
+
+	for i, srv := range servers {
+		select {
+		case <-srv.StopChan():
+		case <-time.After(timeoutTime):
+			t.Fatalf("Timed out while waiting for server %d to stop", i)
+		}
+	}
+	close(signals)
+}
+
+func TestForwardSignalsSkipsPending(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first server never serves, so its signals stay pending.
+	idle := &Server{Server: &http.Server{}, NoSignalHandling: true}
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	signals := make(chan os.Signal)
+	go forwardSignals(signals, []*Server{idle, srv})
+	defer close(signals)
+	for i := 0; i < 3; i++ {
+		select {
+		case signals <- os.Interrupt:
+		case <-time.After(timeoutTime):
+			t.Fatalf("expected signal %d to be forwarded", i)
+		}
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the serving server to stop")
+	}
+}
+
+func TestMinDrainTime(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, MinDrainTime: killTime, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+	if elapsed := time.Since(start); elapsed < killTime {
+		t.Errorf("expected shutdown to take at least %s, took %s", killTime, elapsed)
+	}
+}
+
+func TestListenerCloseDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime * 10)
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {})
+	srv := &Server{
+		Timeout:            killTime,
+		ListenerCloseDelay: killTime,
+		Server:             &http.Server{Handler: mux},
+		NoSignalHandling:   true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	addr := "http://" + l.Addr().String()
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(addr + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	time.Sleep(waitTime)
+	start := time.Now()
+	srv.Stop(killTime)
+
+	// Within ListenerCloseDelay new connections are still accepted.
+	time.Sleep(waitTime)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(addr)
+	if err != nil {
+		t.Fatalf("expected connections to be accepted during ListenerCloseDelay: %v", err)
+	}
+	resp.Body.Close()
+	if snap := srv.Snapshot(); !snap.Draining() || !snap.Accepting {
+		t.Errorf("expected the snapshot to report accepting while draining during ListenerCloseDelay: %+v", snap)
+	}
+
+	// Past it the listener is closed, while the drain goes on.
+	time.Sleep(killTime - time.Since(start) + waitTime)
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("expected the listener to be closed after ListenerCloseDelay")
+	}
+	if srv.Snapshot().Accepting {
+		t.Error("expected the snapshot to report not accepting once the listener is closed")
+	}
+	select {
+	case <-srv.StopChan():
+		t.Fatal("expected the drain to last Timeout after the listener was closed")
+	default:
+	}
+
+	// Timeout after that the remaining connections are killed.
+	select {
+	case <-srv.StopChan():
+	case <-time.After(killTime * 2):
+		t.Fatal("expected the server to stop once Timeout expired")
+	}
+	if elapsed := time.Since(start); elapsed < killTime*2 {
+		t.Errorf("expected ListenerCloseDelay and Timeout to add up, took %s", elapsed)
+	}
+	if err := <-slow; err == nil {
+		t.Error("expected the slow request to be killed")
+	}
+}
+
+func TestDrainComplete(t *testing.T) {
+	for _, busy := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idle int32
+		time.AfterFunc(waitTime+killTime, func() {
+			if !busy {
+				atomic.StoreInt32(&idle, 1)
+			}
+		})
+		srv := &Server{
+			Server:           &http.Server{Handler: http.NotFoundHandler()},
+			DrainComplete:    func() bool { return atomic.LoadInt32(&idle) == 1 },
+			NoSignalHandling: true,
+		}
+		go srv.Serve(l)
+		time.Sleep(waitTime)
+
+		// A busy server is stopped regardless once the timeout expires.
+		start := time.Now()
+		srv.Stop(killTime * 2)
+		select {
+		case <-srv.StopChan():
+		case <-time.After(timeoutTime * 2):
+			t.Fatal("Timed out while waiting for explicit stop to complete")
+		}
+		elapsed := time.Since(start)
+		if elapsed < killTime {
+			t.Errorf("expected shutdown to wait for DrainComplete, took %s", elapsed)
+		}
+		if !busy && elapsed >= killTime*2 {
+			t.Errorf("expected shutdown to complete once DrainComplete did, took %s", elapsed)
+		}
+	}
+}
+
+func TestPollDrain(t *testing.T) {
+	srv := &Server{Server: &http.Server{}, PollDrain: waitTime / 10}
+	add := make(chan net.Conn)
+	shutdown := make(chan chan struct{})
+	go srv.manageConnections(add, nil, nil, nil, nil, nil, nil, nil, shutdown, nil)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	add <- conn
+
+	// The connection is closed as idle, but its removal is never reported.
+	done := make(chan struct{}, 1)
+	shutdown <- done
+	select {
+	case <-done:
+	case <-time.After(waitTime):
+		t.Fatal("expected polling to complete the drain")
+	}
+}
+
+func TestFromHTTPServer(t *testing.T) {
+	called := false
+	hook := func(net.Conn, http.ConnState) { called = true }
+	server := &http.Server{ConnState: hook}
+
+	srv := FromHTTPServer(server, killTime)
+	if srv.Server != server || srv.Timeout != killTime {
+		t.Errorf("unexpected Server %+v", srv)
+	}
+	if server.ConnState != nil || srv.ConnState == nil {
+		t.Fatal("expected ConnState to be moved to the graceful Server")
+	}
+	srv.ConnState(nil, http.StateNew)
+	if !called {
+		t.Error("expected the moved ConnState to be the original one")
+	}
+}
+
+func TestShutdownFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "shutdown")
+
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, ShutdownFile: file, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the shutdown file to stop the server")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected the shutdown file to be removed, got %v", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, MemoryLimit: 1, NoSignalHandling: true}
+	go srv.Serve(l)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(memoryInterval + timeoutTime):
+		t.Fatal("Timed out while waiting for the memory limit to stop the server")
+	}
+}
+
+func TestServeAsync(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	ready, errc := srv.ServeAsync(l)
+	select {
+	case <-ready:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be ready")
+	}
+
+	srv.Stop(0)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+}
+
+func TestServeAsyncError(t *testing.T) {
+	_, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: &http.Server{}, NoSignalHandling: true}
+	ready, errc := srv.ServeAsync(l)
+	select {
+	case err := <-errc:
+		if err != ErrNoHandler {
+			t.Errorf("expected ErrNoHandler, got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the error")
+	}
+	select {
+	case <-ready:
+		t.Error("expected ready not to be closed")
+	default:
+	}
+}
+
+func TestStopAndWait(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), killTime)
+	defer cancel()
+	var remaining []int
+	err = srv.StopAndWait(ctx, func(n int) { remaining = append(remaining, n) })
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the connection to be killed, got %v", err)
+	}
+	if len(remaining) == 0 || remaining[0] != 1 {
+		t.Errorf("expected progress to report the active connection, got %v", remaining)
+	}
+	select {
+	case <-srv.StopChan():
+	default:
+		t.Error("expected the server to be stopped")
+	}
+	wg.Wait()
+}
+
+func TestStopAndWaitIgnoresTimeoutOverrides(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Either override would kill the connection right away.
+	srv := &Server{
+		Server:           server,
+		TimeoutFunc:      func(int) time.Duration { return -1 },
+		TriggerTimeouts:  map[string]time.Duration{TriggerStopAndWait: -1},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), killTime)
+	defer cancel()
+	start := time.Now()
+	if err := srv.StopAndWait(ctx, nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the connection to be killed once ctx was done, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < killTime-waitTime {
+		t.Errorf("expected the drain to last until ctx was done, took %s", elapsed)
+	}
+	wg.Wait()
+}
+
+func TestName(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{Name: "public", Logger: log.New(&buf, "[graceful] ", 0)}
+	srv.logf("shutdown initiated")
+	if buf.String() != "[graceful:public] shutdown initiated\n" {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+
+	var line string
+	srv.LogFunc = func(format string, args ...interface{}) { line = fmt.Sprintf(format, args...) }
+	srv.logf("shutdown initiated")
+	if line != "public: shutdown initiated" {
+		t.Errorf("unexpected log line %q", line)
+	}
+
+	events := srv.Events()
+	srv.publish(Event{Kind: EventStarted})
+	if e := <-events; e.Server != "public" {
+		t.Errorf("expected the event to name the server, got %q", e.Server)
+	}
+}
+
+func TestEffectiveAddr(t *testing.T) {
+	tests := []struct {
+		server   *http.Server
+		expected string
+	}{
+		{&http.Server{}, ":http"},
+		{&http.Server{TLSConfig: &tls.Config{}}, ":https"},
+		{&http.Server{Addr: ":8080"}, ":8080"},
+		{&http.Server{Addr: ":8443", TLSConfig: &tls.Config{}}, ":8443"},
+	}
+
+	for _, test := range tests {
+		srv := &Server{Server: test.server}
+		if addr := srv.EffectiveAddr(); addr != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, addr)
+		}
+	}
+}
+
+func TestManagerHeartbeat(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, ManagerHeartbeat: waitTime / 10, NoSignalHandling: true}
+	if !srv.LastManagerTick().IsZero() {
+		t.Fatal("expected no tick before serving")
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	first := srv.LastManagerTick()
+	time.Sleep(waitTime)
+	if !srv.LastManagerTick().After(first) {
+		t.Error("expected the heartbeat to advance the tick while idle")
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+}
+
+func TestHandshakeGrace(t *testing.T) {
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: http.NotFoundHandler()}
+	srv := &Server{Timeout: killTime, HandshakeGrace: killTime / 2, Server: server, NoSignalHandling: true}
+	go srv.ListenAndServeTLS("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	time.Sleep(waitTime)
+
+	// Connect, but start the TLS handshake only once shutdown has begun.
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+	srv.Stop(killTime)
+	time.Sleep(waitTime)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+			return tlsConn, tlsConn.Handshake()
+		},
+	}}
+	resp, err := client.Get(fmt.Sprintf("https://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("expected the handshake to complete during the grace period: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestExemptPaths(t *testing.T) {
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Timeout:          killTime / 4,
+		ExemptPaths:      []string{"/debug/"},
+		Server:           server,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	get := func(path string, result chan error) {
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%d%s", port, path))
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}
+	exempt := make(chan error, 1)
+	other := make(chan error, 1)
+	go get("/debug/pprof/profile", exempt)
+	go get("/", other)
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime / 4)
+
+	if err := <-other; err == nil {
+		t.Error("expected the request to be killed")
+	}
+	if err := <-exempt; err != nil {
+		t.Errorf("expected the exempt request to complete: %v", err)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestMarkCritical(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/critical", func(rw http.ResponseWriter, r *http.Request) {
+		MarkCritical(r)
+		time.Sleep(killTime)
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime)
+	})
+	srv := &Server{
+		Timeout:          killTime / 4,
+		Server:           &http.Server{Handler: mux},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	get := func(path string, result chan error) {
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Get("http://" + l.Addr().String() + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}
+	critical := make(chan error, 1)
+	other := make(chan error, 1)
+	go get("/critical", critical)
+	go get("/", other)
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime / 4)
+
+	if err := <-other; err == nil {
+		t.Error("expected the request to be killed")
+	}
+	if err := <-critical; err != nil {
+		t.Errorf("expected the critical request to complete: %v", err)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
+
+func TestPostKillGrace(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Timeout:          waitTime,
+		ExemptPaths:      []string{"/"},
+		PostKillGrace:    waitTime,
+		Server:           server,
+		NoSignalHandling: true,
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	time.Sleep(waitTime)
+
+	go func() {
+		client := &http.Client{Transport: &http.Transport{}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	// The exempt request outlives the kill, so Serve gives up on it.
+	srv.Stop(waitTime)
+	select {
+	case err := <-served:
+		if err != ErrConnectionsLingering {
+			t.Errorf("expected ErrConnectionsLingering, got %v", err)
+		}
+	case <-time.After(killTime * 2):
+		t.Fatal("expected Serve to return after PostKillGrace")
+	}
+}
+
+func TestReadyCheck(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := 0
+	srv := &Server{
+		Server: server,
+		ReadyCheck: func() error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("database unreachable")
+			}
+			return nil
+		},
+		ReadyCheckTimeout: timeoutTime,
+		NoSignalHandling:  true,
+	}
+	go srv.Serve(l)
+
+	// The request is queued until the server is ready.
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+
+	srv.Stop(0)
+	<-srv.StopChan()
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestReadyCheckTimesOut(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unreachable := errors.New("database unreachable")
+	srv := &Server{
+		Server:            server,
+		ReadyCheck:        func() error { return unreachable },
+		ReadyCheckTimeout: waitTime * 2,
+		NoSignalHandling:  true,
+	}
+	if err := srv.Serve(l); !errors.Is(err, unreachable) {
+		t.Fatalf("expected the readiness error, got %v", err)
+	}
+}
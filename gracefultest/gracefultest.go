@@ -0,0 +1,38 @@
+// Package gracefultest provides assertions for testing code that serves
+// with graceful.
+package gracefultest
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+// exitWait is how long AssertDrained waits for the goroutine tracking
+// connections to exit once the server has stopped.
+const exitWait = time.Second
+
+// AssertDrained checks that srv has shut down without leaking connections:
+// it has stopped, no connections are left and the goroutine tracking them
+// has exited. Failures are reported through t.
+func AssertDrained(t testing.TB, srv *graceful.Server) {
+	t.Helper()
+
+	select {
+	case <-srv.StopChan():
+	default:
+		t.Errorf("server has not stopped")
+		return
+	}
+	if n := srv.Snapshot().Connections; n != 0 {
+		t.Errorf("%d connections left after shutdown", n)
+	}
+	for deadline := time.Now().Add(exitWait); srv.ManagerRunning(); {
+		if time.Now().After(deadline) {
+			t.Errorf("connection manager still running %s after shutdown", exitWait)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
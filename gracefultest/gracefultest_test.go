@@ -0,0 +1,47 @@
+package gracefultest
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+// recorder is a testing.TB that records failures instead of failing.
+type recorder struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failed = true
+}
+
+func serve(t *testing.T) *graceful.Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &graceful.Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(100 * time.Millisecond)
+	return srv
+}
+
+func TestAssertDrained(t *testing.T) {
+	srv := serve(t)
+
+	r := &recorder{TB: t}
+	AssertDrained(r, srv)
+	if !r.failed {
+		t.Error("expected a running server to fail the assertion")
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+	AssertDrained(t, srv)
+}
@@ -0,0 +1,81 @@
+package gracefultest
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by ManualListener once it is closed.
+var ErrListenerClosed = errors.New("listener closed")
+
+// ManualListener is a net.Listener whose connections are pushed in by the
+// test, so that a graceful.Server's serve, drain and kill cycle can be
+// exercised deterministically without network I/O. Accept returns only
+// when a connection is pushed or the listener is closed.
+//
+// Example:
+//	l := gracefultest.NewManualListener()
+//	go srv.Serve(l)
+//	client, err := l.Dial()
+type ManualListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewManualListener returns a ManualListener with no connections pending.
+func NewManualListener() *ManualListener {
+	return &ManualListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Accept waits for a connection to be pushed and returns it.
+func (l *ManualListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops the listener. Pending and later pushes fail.
+func (l *ManualListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns a placeholder address.
+func (l *ManualListener) Addr() net.Addr {
+	return manualAddr{}
+}
+
+// Push hands c to the server, waiting until it is accepted. It fails with
+// ErrListenerClosed if the listener is closed first.
+func (l *ManualListener) Push(c net.Conn) error {
+	select {
+	case l.conns <- c:
+		return nil
+	case <-l.closed:
+		return ErrListenerClosed
+	}
+}
+
+// Dial pushes the server end of an in-memory connection and returns the
+// client end, through which the test sends requests and reads responses.
+// Closing the client end makes the server see the connection go away.
+func (l *ManualListener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	if err := l.Push(server); err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// manualAddr is the address of a ManualListener.
+type manualAddr struct{}
+
+func (manualAddr) Network() string { return "manual" }
+func (manualAddr) String() string  { return "manual" }
@@ -0,0 +1,48 @@
+package gracefultest
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+func TestManualListener(t *testing.T) {
+	l := NewManualListener()
+	srv := &graceful.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusTeapot)
+		})},
+		NoSignalHandling: true,
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	client, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	fmt.Fprint(client, "GET / HTTP/1.1\r\nHost: manual\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Errorf("expected status %d, got %d", http.StatusTeapot, resp.StatusCode)
+	}
+
+	srv.Stop(time.Second)
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %s", err)
+	}
+	AssertDrained(t, srv)
+
+	if _, err := l.Dial(); err != ErrListenerClosed {
+		t.Errorf("expected ErrListenerClosed after shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrShutdownPending is returned by Shutdown.Result while the drain is
+// still in progress.
+var ErrShutdownPending = errors.New("shutdown still in progress")
+
+// shutdownResult is the outcome of the most recent shutdown.
+type shutdownResult struct {
+	killed   int
+	timedOut bool
+	err      error
+}
+
+// Shutdown is a handle on a shutdown started by BeginShutdown.
+type Shutdown struct {
+	srv  *Server
+	done <-chan struct{}
+}
+
+// BeginShutdown triggers a graceful shutdown, as if Stop(Timeout) had been
+// called, and returns right away with a handle to wait on or poll for its
+// completion. The handle is only ever done once Serve has been called.
+func (srv *Server) BeginShutdown() Shutdown {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+
+	done := srv.StopChan()
+	srv.interruptChan() <- stopSignal{}
+	return Shutdown{srv: srv, done: done}
+}
+
+// Done returns a channel that is closed once the shutdown has completed.
+func (s Shutdown) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait blocks until the shutdown has completed, returning its error, or
+// until ctx is done, returning ctx.Err(). The drain carries on regardless.
+func (s Shutdown) Wait(ctx context.Context) error {
+	select {
+	case <-s.done:
+		_, err := s.Result()
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Result returns the number of connections killed because the drain timed
+// out and the error the shutdown ended with, such as
+// ErrConnectionsLingering, or ErrShutdownPending if it has not completed.
+func (s Shutdown) Result() (killed int, err error) {
+	select {
+	case <-s.done:
+	default:
+		return 0, ErrShutdownPending
+	}
+
+	s.srv.chanLock.RLock()
+	defer s.srv.chanLock.RUnlock()
+	return s.srv.shutdownResult.killed, s.srv.shutdownResult.err
+}
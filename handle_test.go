@@ -0,0 +1,52 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBeginShutdown(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	time.Sleep(waitTime)
+
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	time.Sleep(waitTime)
+
+	// Kills counted before, and stats reset while draining, don't affect
+	// the count of this shutdown.
+	srv.stats.kill(3, 1)
+	s := srv.BeginShutdown()
+	if _, err := s.Result(); err != ErrShutdownPending {
+		t.Errorf("expected ErrShutdownPending while draining, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), waitTime)
+	defer cancel()
+	if err := s.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to be cut short by ctx, got %v", err)
+	}
+	srv.ResetStats()
+
+	if err := s.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("expected Done to be closed")
+	}
+	if killed, err := s.Result(); killed != 1 || err != nil {
+		t.Errorf("expected 1 connection killed and no error, got %d, %v", killed, err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
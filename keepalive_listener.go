@@ -25,8 +25,11 @@ func (ln keepAliveListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	kac := c.(keepAliveConn)
-	kac.SetKeepAlive(true)
-	kac.SetKeepAlivePeriod(ln.keepAlivePeriod)
+	// Connections that don't support keep-alives, e.g. from a custom
+	// listener, are served without them.
+	if kac, ok := c.(keepAliveConn); ok {
+		kac.SetKeepAlive(true)
+		kac.SetKeepAlivePeriod(ln.keepAlivePeriod)
+	}
 	return c, nil
 }
@@ -0,0 +1,92 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// pipeListener is a net.Listener whose connections are in-memory pipes
+// that support neither keep-alives nor anything else TCP specific.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) Dial(network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestKeepAliveListenerNonTCP(t *testing.T) {
+	pl := newPipeListener()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		conn, _ := ConnFromContext(r.Context())
+		(&Server{}).ExtendDeadline(conn, time.Second)
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	srv := &Server{
+		Timeout:          killTime,
+		ListenLimit:      concurrentRequestN,
+		Server:           &http.Server{Handler: mux},
+		NoSignalHandling: true,
+	}
+	go srv.Serve(keepAliveListener{pl, time.Minute})
+
+	client := &http.Client{Transport: &http.Transport{Dial: pl.Dial}}
+	resp, err := client.Get("http://pipe/")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for explicit stop to complete")
+	}
+}
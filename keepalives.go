@@ -0,0 +1,42 @@
+package graceful
+
+import "sync"
+
+// keepAlives is the HTTP keep-alive state set by SetKeepAlives.
+type keepAlives struct {
+	sync.Mutex
+
+	// shuttingDown keeps keep-alives disabled once shutdown has begun.
+	shuttingDown bool
+}
+
+// SetKeepAlives enables or disables HTTP keep-alives at runtime without
+// shutting down, e.g. to have clients reconnect, and so be rebalanced,
+// after their next request. Once shutdown has begun keep-alives stay
+// disabled, and enabling them has no effect until the server serves again.
+func (srv *Server) SetKeepAlives(enabled bool) {
+	srv.keepAlives.Lock()
+	defer srv.keepAlives.Unlock()
+
+	if enabled && srv.keepAlives.shuttingDown {
+		return
+	}
+	srv.SetKeepAlivesEnabled(enabled)
+}
+
+// disableKeepAlives disables keep-alives for the rest of the shutdown.
+func (srv *Server) disableKeepAlives() {
+	srv.keepAlives.Lock()
+	defer srv.keepAlives.Unlock()
+
+	srv.keepAlives.shuttingDown = true
+	srv.SetKeepAlivesEnabled(false)
+}
+
+// resetKeepAlives allows keep-alives to be enabled again when serving.
+func (srv *Server) resetKeepAlives() {
+	srv.keepAlives.Lock()
+	defer srv.keepAlives.Unlock()
+
+	srv.keepAlives.shuttingDown = false
+}
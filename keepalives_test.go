@@ -0,0 +1,52 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetKeepAlives(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	// closes reports whether the server asks the client to close the
+	// connection after a request.
+	closes := func() bool {
+		client := &http.Client{Transport: &http.Transport{}}
+		resp, err := client.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Close
+	}
+
+	if closes() {
+		t.Error("expected keep-alives to be enabled by default")
+	}
+	srv.SetKeepAlives(false)
+	if !closes() {
+		t.Error("expected keep-alives to be disabled")
+	}
+	srv.SetKeepAlives(true)
+	if closes() {
+		t.Error("expected keep-alives to be enabled again")
+	}
+	if state := srv.Snapshot().State; state != StateServing {
+		t.Errorf("expected the server to keep serving, got %s", state)
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+	srv.SetKeepAlives(true)
+	if !srv.keepAlives.shuttingDown {
+		t.Error("expected keep-alives to stay disabled after shutdown")
+	}
+}
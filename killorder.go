@@ -0,0 +1,53 @@
+package graceful
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+)
+
+// KillOrder determines the order in which connections are closed when
+// KillRate paces closing them.
+type KillOrder int
+
+const (
+	// KillRandom closes connections in random order.
+	KillRandom KillOrder = iota
+
+	// KillOldest closes the longest-lived connections first.
+	KillOldest
+
+	// KillNewest closes the most recently accepted connections first.
+	KillNewest
+
+	// KillIdleFirst closes idle connections before those serving requests,
+	// each oldest first, giving active requests the most time to finish.
+	KillIdleFirst
+)
+
+// orderKill sorts conns into the order in which KillOrder says they should
+// be closed, after those from IPs that have used up their MaxConnsPerIP
+// quota. It must only be called by the connection manager.
+func (srv *Server) orderKill(conns []net.Conn) {
+	oldest := func(i, j int) bool {
+		return srv.connections[conns[i]].Before(srv.connections[conns[j]])
+	}
+	switch srv.KillOrder {
+	case KillOldest:
+		sort.SliceStable(conns, oldest)
+	case KillNewest:
+		sort.SliceStable(conns, func(i, j int) bool { return oldest(j, i) })
+	case KillIdleFirst:
+		sort.SliceStable(conns, func(i, j int) bool {
+			_, idleI := srv.idleConnections[conns[i]]
+			_, idleJ := srv.idleConnections[conns[j]]
+			if idleI != idleJ {
+				return idleI
+			}
+			return oldest(i, j)
+		})
+	default:
+		rand.Shuffle(len(conns), func(i, j int) { conns[i], conns[j] = conns[j], conns[i] })
+	}
+	srv.orderQuota(conns)
+}
@@ -0,0 +1,25 @@
+package graceful
+
+import "errors"
+
+// ErrListenerFDUnsupported is returned by ListenerFD on platforms where
+// file descriptors can't be duplicated.
+var ErrListenerFDUnsupported = errors.New("ListenerFD is not supported on this platform")
+
+// ListenerFD returns a file descriptor for the server's TCP or Unix
+// listener, e.g. to attach probes to it or pass it to another process. The
+// descriptor is a duplicate, referring to the same socket but owned by the
+// caller, who must close it, e.g. with syscall.Close, once done with it.
+// Closing it leaves the server's listener open, and the server closing its
+// listener leaves the duplicate, and so the socket, open. It returns
+// ErrNoRestartListener if the server has no such listener.
+func (srv *Server) ListenerFD() (uintptr, error) {
+	srv.chanLock.RLock()
+	l := srv.restartListener
+	srv.chanLock.RUnlock()
+	fl, ok := l.(filer)
+	if !ok {
+		return 0, ErrNoRestartListener
+	}
+	return dupListenerFD(fl)
+}
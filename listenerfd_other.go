@@ -0,0 +1,7 @@
+//+build appengine !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package graceful
+
+func dupListenerFD(fl filer) (uintptr, error) {
+	return 0, ErrListenerFDUnsupported
+}
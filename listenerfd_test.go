@@ -0,0 +1,40 @@
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestListenerFD(t *testing.T) {
+	srv := &Server{Server: &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	if _, err := srv.ListenerFD(); err != ErrNoRestartListener {
+		t.Errorf("expected ErrNoRestartListener before serving, got %v", err)
+	}
+	go srv.ListenAndServe()
+	time.Sleep(waitTime)
+
+	fd, err := srv.ListenerFD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Stop(0)
+	<-srv.StopChan()
+
+	// The duplicate keeps the socket open after the server has closed its
+	// listener.
+	f := os.NewFile(fd, "listener")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Errorf("expected the duplicated listener to accept connections: %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+//+build !appengine
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import "syscall"
+
+// dupListenerFD returns a duplicate of the file descriptor of fl that is
+// not tied to an *os.File, whose finalizer would close it.
+func dupListenerFD(fl filer) (uintptr, error) {
+	// File already returns a duplicate, but owned by the *os.File.
+	f, err := fl.File()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return 0, err
+	}
+	return uintptr(fd), nil
+}
@@ -0,0 +1,43 @@
+package graceful
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	// LevelDebug is the level of diagnostic messages, such as the notes of
+	// AcceptIdleWarn. They are only written as text if LogDebug is set.
+	LevelDebug LogLevel = iota - 1
+
+	// LevelInfo is the level of messages about the normal course of
+	// serving and shutting down.
+	LevelInfo
+
+	// LevelWarn is the level of messages about conditions that may need
+	// attention, such as a shutdown being escalated.
+	LevelWarn
+
+	// LevelError is the level of messages about failures.
+	LevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// StructuredLogger receives graceful's log messages in structured form.
+// fields describe the message, e.g. "error" for the error being reported,
+// and include "server" with the Server's Name, if it has one. Log may be
+// called concurrently.
+type StructuredLogger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
@@ -0,0 +1,67 @@
+package graceful
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+)
+
+// structuredRecorder collects the messages logged through a
+// StructuredLogger.
+type structuredRecorder struct {
+	sync.Mutex
+	entries []structuredEntry
+}
+
+type structuredEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+func (r *structuredRecorder) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries = append(r.entries, structuredEntry{level, msg, fields})
+}
+
+func TestStructuredLogger(t *testing.T) {
+	var buf bytes.Buffer
+	rec := &structuredRecorder{}
+	srv := &Server{Name: "api", Logger: log.New(&buf, "", 0), StructuredLogger: rec}
+
+	err := errors.New("boom")
+	srv.logw(LevelError, map[string]interface{}{"error": err}, "closing: %s", err)
+
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be logged as text, got %q", buf.String())
+	}
+	if len(rec.entries) != 1 {
+		t.Fatalf("expected one structured entry, got %d", len(rec.entries))
+	}
+	e := rec.entries[0]
+	if e.level != LevelError || e.msg != "closing: boom" || e.fields["error"] != err || e.fields["server"] != "api" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
+
+func TestLogLevelText(t *testing.T) {
+	var buf bytes.Buffer
+	srv := &Server{Logger: log.New(&buf, "", 0)}
+
+	srv.logw(LevelError, nil, "closing: %s", "boom")
+	srv.logw(LevelWarn, nil, "escalated")
+	srv.logw(LevelDebug, nil, "idle")
+	if expected := "[ERROR] closing: boom\nescalated\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	srv.LogDebug = true
+	srv.logw(LevelDebug, nil, "idle")
+	if expected := "idle\n"; buf.String() != expected {
+		t.Errorf("expected %q with LogDebug, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,569 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// managerHarness drives the connection manager directly, without an HTTP
+// server.
+type managerHarness struct {
+	srv                       *Server
+	add, idle, active, remove chan net.Conn
+	hijacked                  chan net.Conn
+	started, finished         chan *request
+	shutdown                  chan chan struct{}
+	kill                      chan struct{}
+	exited                    chan struct{}
+}
+
+func newManagerHarness(srv *Server) *managerHarness {
+	h := &managerHarness{
+		srv:      srv,
+		add:      make(chan net.Conn),
+		idle:     make(chan net.Conn),
+		active:   make(chan net.Conn),
+		remove:   make(chan net.Conn),
+		hijacked: make(chan net.Conn),
+		started:  make(chan *request),
+		finished: make(chan *request),
+		shutdown: make(chan chan struct{}),
+		kill:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	go func() {
+		defer close(h.exited)
+		h.srv.manageConnections(h.add, h.idle, h.active, h.remove, h.hijacked, h.started, h.finished, nil, h.shutdown, h.kill)
+	}()
+	return h
+}
+
+// conn adds an active connection and returns the client end of it.
+func (h *managerHarness) conn() (client, server net.Conn) {
+	client, server = net.Pipe()
+	h.add <- server
+	h.active <- server
+	return client, server
+}
+
+// expectDone waits for the manager to report the drain complete and exit.
+func (h *managerHarness) expectDone(t *testing.T, done chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(waitTime):
+		t.Fatal("expected the drain to complete")
+	}
+	select {
+	case <-h.exited:
+	case <-time.After(waitTime):
+		t.Fatal("expected the manager to exit")
+	}
+}
+
+func TestManagerShutdownWithoutConnections(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}})
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	h.expectDone(t, done)
+}
+
+func TestManagerDrainsActiveConnection(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}})
+	client, conn := h.conn()
+	defer client.Close()
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	select {
+	case <-done:
+		t.Fatal("expected the drain to wait for the active connection")
+	case <-time.After(waitTime):
+	}
+
+	h.remove <- conn
+	h.expectDone(t, done)
+}
+
+func TestManagerClosesIdleConnectionsOnShutdown(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}})
+	client, conn := h.conn()
+	defer client.Close()
+	h.idle <- conn
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+
+	h.remove <- conn
+	h.expectDone(t, done)
+}
+
+func TestManagerKillClosesConnections(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}})
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		client, _ := h.conn()
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	h.expectDone(t, done)
+
+	for i, client := range clients {
+		if _, err := client.Read(make([]byte, 1)); err == nil {
+			t.Errorf("expected connection %d to be closed", i)
+		}
+	}
+	if snap := h.srv.Snapshot(); snap.KilledConnections != 3 || snap.Connections != 0 {
+		t.Errorf("unexpected snapshot after kill: %+v", snap)
+	}
+}
+
+func TestManagerCloseReasons(t *testing.T) {
+	reasons := make(chan CloseReason, 5)
+	h := newManagerHarness(&Server{
+		Server:      &http.Server{},
+		OnConnClose: func(conn net.Conn, reason CloseReason) { reasons <- reason },
+	})
+
+	client, conn := h.conn()
+	defer client.Close()
+	h.remove <- conn
+	client, conn = h.conn()
+	defer client.Close()
+	h.hijacked <- conn
+
+	client, idle := h.conn()
+	defer client.Close()
+	h.idle <- idle
+	client, active := h.conn()
+	defer client.Close()
+	client, _ = h.conn()
+	defer client.Close()
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	h.remove <- idle
+	h.remove <- active
+	// The last connection is still active when the drain times out.
+	close(h.kill)
+	h.expectDone(t, done)
+
+	close(reasons)
+	var got []CloseReason
+	for r := range reasons {
+		got = append(got, r)
+	}
+	expected := []CloseReason{CloseServing, CloseHijacked, CloseIdle, CloseDrained, CloseKilled}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected reasons %v, got %v", expected, got)
+	}
+}
+
+func TestManagerKillRate(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}, KillRate: 20})
+	for i := 0; i < 3; i++ {
+		client, _ := h.conn()
+		defer client.Close()
+	}
+
+	start := time.Now()
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	<-done
+	// The first connection is closed right away, the others 50ms apart.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the kills to be paced, took %s", elapsed)
+	}
+}
+
+func TestManagerKillOrder(t *testing.T) {
+	for _, test := range []struct {
+		order KillOrder
+		want  []int
+	}{
+		{KillOldest, []int{0, 1, 2}},
+		{KillNewest, []int{2, 1, 0}},
+		{KillIdleFirst, []int{1, 0, 2}},
+	} {
+		closed := make(chan net.Conn, 3)
+		h := newManagerHarness(&Server{
+			Server:    &http.Server{},
+			KillRate:  1000,
+			KillOrder: test.order,
+			CloseConn: func(conn net.Conn) error {
+				closed <- conn
+				return conn.Close()
+			},
+		})
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			client, conn := h.conn()
+			defer client.Close()
+			conns = append(conns, conn)
+			time.Sleep(time.Millisecond)
+		}
+		h.idle <- conns[1]
+
+		done := make(chan struct{}, 1)
+		h.shutdown <- done
+		close(h.kill)
+		h.expectDone(t, done)
+		for _, i := range test.want {
+			if conn := <-closed; conn != conns[i] {
+				t.Errorf("KillOrder %d: expected connection %d to be closed next", test.order, i)
+			}
+		}
+	}
+}
+
+func TestManagerMaxConcurrentCloses(t *testing.T) {
+	const limit = 2
+	var closing, peak int32
+	h := newManagerHarness(&Server{
+		Server:              &http.Server{},
+		MaxConcurrentCloses: limit,
+		CloseConn: func(conn net.Conn) error {
+			n := atomic.AddInt32(&closing, 1)
+			defer atomic.AddInt32(&closing, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return conn.Close()
+		},
+	})
+	for i := 0; i < 6; i++ {
+		client, _ := h.conn()
+		defer client.Close()
+	}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	h.expectDone(t, done)
+	if p := atomic.LoadInt32(&peak); p != limit {
+		t.Errorf("expected at most %d concurrent closes, got %d", limit, p)
+	}
+}
+
+func TestManagerKillCancelsConnContext(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}})
+	client, conn := h.conn()
+	defer client.Close()
+
+	// The context must already be cancelled when the connection closes.
+	cancelled := make(chan struct{})
+	h.srv.connCancels.add(conn, func() { close(cancelled) })
+	go func() {
+		client.Read(make([]byte, 1))
+		select {
+		case <-cancelled:
+		default:
+			t.Error("expected the context to be cancelled before the connection was closed")
+		}
+	}()
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	h.expectDone(t, done)
+
+	select {
+	case <-cancelled:
+	case <-time.After(waitTime):
+		t.Fatal("expected the context of the killed connection to be cancelled")
+	}
+}
+
+func TestManagerShutdownUnderConnectionChurn(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without a Timeout, a lost removal leaves the drain hanging.
+		srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+		go srv.Serve(l)
+		time.Sleep(waitTime / 10)
+
+		// Open connections and close them right away, after sending a
+		// request or without sending anything, while shutting down.
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < concurrentRequestN; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					c, err := net.Dial("tcp", l.Addr().String())
+					if err != nil {
+						return
+					}
+					if (n+j)%2 == 0 {
+						fmt.Fprint(c, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+					}
+					c.Close()
+				}
+			}(j)
+		}
+		time.Sleep(time.Duration(i) * time.Millisecond)
+
+		srv.Stop(0)
+		select {
+		case <-srv.StopChan():
+		case <-time.After(timeoutTime):
+			t.Fatalf("iteration %d: expected the drain to complete, %d connections left", i, srv.Snapshot().Connections)
+		}
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestManagerCloseConn(t *testing.T) {
+	killed := make(chan net.Conn, 2)
+	h := newManagerHarness(&Server{
+		Server: &http.Server{},
+		CloseConn: func(conn net.Conn) error {
+			killed <- conn
+			return conn.Close()
+		},
+	})
+	client, idle := h.conn()
+	defer client.Close()
+	h.idle <- idle
+	client, active := h.conn()
+	defer client.Close()
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	h.remove <- idle
+	close(h.kill)
+	h.expectDone(t, done)
+
+	// Idle connections closed when shutdown begins aren't killed.
+	close(killed)
+	var got []net.Conn
+	for conn := range killed {
+		got = append(got, conn)
+	}
+	if len(got) != 1 || got[0] != active {
+		t.Errorf("expected CloseConn to kill just the active connection, got %v", got)
+	}
+}
+
+func TestManagerKillIdempotentOnly(t *testing.T) {
+	h := newManagerHarness(&Server{Server: &http.Server{}, KillIdempotentOnly: true})
+	getClient, get := h.conn()
+	defer getClient.Close()
+	h.started <- &request{conn: get, Request: httptest.NewRequest("GET", "/", nil)}
+	postClient, post := h.conn()
+	defer postClient.Close()
+	h.started <- &request{conn: post, Request: httptest.NewRequest("POST", "/", nil)}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	select {
+	case <-done:
+		t.Fatal("expected the drain to wait for the POST request")
+	case <-time.After(waitTime):
+	}
+	if _, err := getClient.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection serving GET to be killed")
+	}
+
+	// The POST request completes undisturbed.
+	postClient.SetReadDeadline(time.Now().Add(waitTime))
+	_, err := postClient.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected the connection serving POST to be spared, got %v", err)
+	}
+	h.remove <- post
+	h.expectDone(t, done)
+}
+
+func TestManagerKilledConnectionReportedOnce(t *testing.T) {
+	closes := make(chan CloseReason, 4)
+	h := newManagerHarness(&Server{
+		Server:             &http.Server{},
+		KillIdempotentOnly: true,
+		OnConnClose:        func(conn net.Conn, reason CloseReason) { closes <- reason },
+	})
+	events := h.srv.Events()
+	getClient, get := h.conn()
+	defer getClient.Close()
+	h.started <- &request{conn: get, Request: httptest.NewRequest("GET", "/", nil)}
+	postClient, post := h.conn()
+	defer postClient.Close()
+	h.started <- &request{conn: post, Request: httptest.NewRequest("POST", "/", nil)}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+
+	// The killed connection reports its closing while the spared one keeps
+	// the manager running.
+	h.remove <- get
+	h.remove <- post
+	h.expectDone(t, done)
+
+	close(closes)
+	var reasons []CloseReason
+	for reason := range closes {
+		reasons = append(reasons, reason)
+	}
+	expected := []CloseReason{CloseKilled, CloseDrained}
+	if fmt.Sprint(reasons) != fmt.Sprint(expected) {
+		t.Errorf("unexpected close reasons %v, expected %v", reasons, expected)
+	}
+	var closed int
+	for _, e := range collectEvents(events) {
+		if e.Kind == EventConnClosed {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("expected only the spared connection to publish its closing, got %d events", closed)
+	}
+}
+
+func TestManagerIsTracked(t *testing.T) {
+	srv := &Server{Server: &http.Server{}}
+	if srv.IsTracked(nil) {
+		t.Error("expected nothing to be tracked before serving")
+	}
+	h := newManagerHarness(srv)
+	srv.managed = h.exited
+
+	client, conn := h.conn()
+	defer client.Close()
+	if !srv.IsTracked(conn) {
+		t.Error("expected the added connection to be tracked")
+	}
+	h.remove <- conn
+	if srv.IsTracked(conn) {
+		t.Error("expected the removed connection not to be tracked")
+	}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	h.expectDone(t, done)
+	if srv.IsTracked(conn) {
+		t.Error("expected nothing to be tracked once the manager exited")
+	}
+}
+
+func TestShutdownAfterManagerExited(t *testing.T) {
+	srv := &Server{Server: &http.Server{}, Timeout: timeoutTime}
+	h := newManagerHarness(srv)
+	srv.tracker.Store(srv.trackRequests(nil, h.started, h.finished, h.exited))
+	client, _ := h.conn()
+	defer client.Close()
+
+	// Kill the connections so that the manager exits before shutdown
+	// attempts its handshake.
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	h.expectDone(t, done)
+
+	returned := make(chan error, 1)
+	go func() { returned <- srv.shutdown(h.shutdown, make(chan struct{}), nil, h.exited) }()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(waitTime):
+		t.Fatal("expected shutdown to return once the manager has exited")
+	}
+}
+
+func TestManagerOnRequestKilled(t *testing.T) {
+	var killed []KilledRequest
+	h := newManagerHarness(&Server{
+		Server:          &http.Server{},
+		OnRequestKilled: func(r KilledRequest) { killed = append(killed, r) },
+	})
+	client, conn := h.conn()
+	defer client.Close()
+	r := httptest.NewRequest("POST", "/orders", nil)
+	r.Header.Set(RequestIDHeader, "42")
+	h.started <- &request{conn: conn, Request: r}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	h.expectDone(t, done)
+	if len(killed) != 1 {
+		t.Fatalf("expected 1 killed request, got %d", len(killed))
+	}
+	if k := killed[0]; k.Method != "POST" || k.Path != "/orders" || k.RequestID != "42" {
+		t.Errorf("expected the killed request to be identified, got %+v", k)
+	}
+}
+
+func TestManagerMaxConnLifetime(t *testing.T) {
+	reasons := make(chan CloseReason, 2)
+	h := newManagerHarness(&Server{
+		Server:          &http.Server{},
+		MaxConnLifetime: waitTime,
+		OnConnClose:     func(conn net.Conn, reason CloseReason) { reasons <- reason },
+	})
+	activeClient, active := h.conn()
+	defer activeClient.Close()
+	idleClient, idle := h.conn()
+	defer idleClient.Close()
+	h.idle <- idle
+
+	// The idle connection is recycled once expired, the active one only
+	// once it has finished its request.
+	time.Sleep(waitTime * 3)
+	if _, err := idleClient.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the expired idle connection to be closed")
+	}
+	activeClient.SetReadDeadline(time.Now().Add(waitTime))
+	_, err := activeClient.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected the expired active connection to stay open, got %v", err)
+	}
+	h.idle <- active
+	activeClient.SetReadDeadline(time.Time{})
+	if _, err := activeClient.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the expired connection to be closed once idle")
+	}
+
+	h.remove <- idle
+	h.remove <- active
+	for i := 0; i < 2; i++ {
+		if r := <-reasons; r != CloseExpired {
+			t.Errorf("expected the connections to be closed as expired, got %s", r)
+		}
+	}
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	h.expectDone(t, done)
+}
@@ -0,0 +1,47 @@
+package graceful
+
+import (
+	"os"
+	"runtime"
+	"time"
+)
+
+// memoryInterval is how often the heap is checked against MemoryLimit.
+const memoryInterval = time.Second
+
+// watchMemory triggers a graceful shutdown once the heap has exceeded
+// MemoryLimit for MemoryLimitDuration.
+func (srv *Server) watchMemory(interrupt chan os.Signal, quitting chan struct{}) {
+	ticker := time.NewTicker(memoryInterval)
+	defer ticker.Stop()
+
+	// exceeded is when the heap was first seen above the limit.
+	var exceeded time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-quitting:
+			return
+		}
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc <= srv.MemoryLimit {
+			exceeded = time.Time{}
+			continue
+		}
+		if exceeded.IsZero() {
+			exceeded = time.Now()
+		}
+		if time.Since(exceeded) < srv.MemoryLimitDuration {
+			continue
+		}
+
+		srv.logw(LevelWarn, map[string]interface{}{"heap": m.HeapAlloc, "limit": srv.MemoryLimit},
+			"heap of %d bytes exceeds MemoryLimit of %d bytes", m.HeapAlloc, srv.MemoryLimit)
+		select {
+		case interrupt <- cancelSignal{}:
+		case <-quitting:
+		}
+		return
+	}
+}
@@ -0,0 +1,258 @@
+package graceful
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// overload holds the state set by SetOverload.
+type overload struct {
+	sync.RWMutex
+	on         bool
+	status     int
+	retryAfter time.Duration
+}
+
+// SetOverload turns load shedding by OverloadMiddleware on or off. While on,
+// new requests are answered with status, and a Retry-After header if
+// retryAfter is positive, while requests already being handled finish
+// normally. A zero status defaults to 429 Too Many Requests.
+func (srv *Server) SetOverload(on bool, status int, retryAfter time.Duration) {
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+
+	srv.overload.Lock()
+	defer srv.overload.Unlock()
+
+	srv.overload.on = on
+	srv.overload.status = status
+	srv.overload.retryAfter = retryAfter
+}
+
+// OverloadMiddleware wraps next so that it sheds requests while the server
+// is overloaded, as set by SetOverload. Connections are kept open, so
+// clients can retry over the same keep-alive connection.
+func (srv *Server) OverloadMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		srv.overload.RLock()
+		on, status, retryAfter := srv.overload.on, srv.overload.status, srv.overload.retryAfter
+		srv.overload.RUnlock()
+
+		if !on {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		if retryAfter > 0 {
+			rw.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+		}
+		http.Error(rw, http.StatusText(status), status)
+	})
+}
+
+// retryAfterSeconds formats d as a Retry-After value, rounding up to whole
+// seconds.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// RejectUpgradesOnShutdown wraps next so that protocol upgrade requests,
+// such as WebSocket handshakes, are answered with 503 Service Unavailable
+// once shutdown has begun, rather than establishing long-lived connections
+// that shutdown would only have to kill. Upgrades that reached next before
+// then complete, after which their connections are hijacked and no longer
+// tracked by graceful.
+func (srv *Server) RejectUpgradesOnShutdown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if isUpgrade(r) && srv.stats.current() >= StateDraining {
+			srv.stats.rejected()
+			rw.Header().Set("Connection", "close")
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// isUpgrade reports whether r asks to upgrade the connection to another
+// protocol.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DrainingHeader is the response header DrainHeaderMiddleware sets while
+// the server is draining.
+const DrainingHeader = "X-Server-Draining"
+
+// DrainHeaderMiddleware wraps next so that responses started while the
+// server is draining, including those of requests that were already in
+// flight when shutdown began, carry a DrainingHeader with the number of
+// seconds left until the remaining connections are killed, rounded up, or
+// -1 if the drain has no deadline. Clients that understand it can fail over
+// before their connection goes away.
+func (srv *Server) DrainHeaderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(exposeWriter(&drainHeaderWriter{ResponseWriter: rw, srv: srv}, rw), r)
+	})
+}
+
+// drainHeaderWriter sets the DrainingHeader when the response is started.
+type drainHeaderWriter struct {
+	http.ResponseWriter
+	srv         *Server
+	wroteHeader bool
+}
+
+func (w *drainHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.srv.stats.current() == StateDraining {
+			w.Header().Set(DrainingHeader, w.srv.drainingValue())
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *drainHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush is only exposed to handlers if the underlying ResponseWriter is an
+// http.Flusher.
+func (w *drainHeaderWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// drainingValue returns the value of the DrainingHeader.
+func (srv *Server) drainingValue() string {
+	d := srv.RemainingDrainTime()
+	if d == math.MaxInt64 {
+		return "-1"
+	}
+	return retryAfterSeconds(d)
+}
+
+// streams holds the streaming responses tracked by FlushMiddleware.
+type streams struct {
+	sync.Mutex
+	writers map[*flushWriter]struct{}
+}
+
+// FlushMiddleware wraps next so that responses it has started writing are
+// flushed when shutdown begins and again right before connections are
+// killed, so that buffered data reaches streaming clients rather than
+// being dropped by the forced close.
+func (srv *Server) FlushMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		f, ok := rw.(http.Flusher)
+		if !ok {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		fw := &flushWriter{ResponseWriter: rw, flusher: f}
+		srv.streams.Lock()
+		if srv.streams.writers == nil {
+			srv.streams.writers = make(map[*flushWriter]struct{})
+		}
+		srv.streams.writers[fw] = struct{}{}
+		srv.streams.Unlock()
+		defer func() {
+			srv.streams.Lock()
+			delete(srv.streams.writers, fw)
+			srv.streams.Unlock()
+		}()
+
+		next.ServeHTTP(exposeWriter(fw, rw), r)
+	})
+}
+
+// flushWait bounds how long shutdown waits for flushStreams, since writes
+// to slow clients may block it.
+const flushWait = 100 * time.Millisecond
+
+// flushStreams flushes the responses tracked by FlushMiddleware that have
+// data written, giving up on waiting for them after flushWait.
+func (srv *Server) flushStreams() {
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+
+		// A writer blocked on a slow client must not keep the other
+		// handlers from untracking theirs.
+		srv.streams.Lock()
+		writers := make([]*flushWriter, 0, len(srv.streams.writers))
+		for fw := range srv.streams.writers {
+			writers = append(writers, fw)
+		}
+		srv.streams.Unlock()
+		for _, fw := range writers {
+			fw.flushWritten()
+		}
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(flushWait):
+	}
+}
+
+// flushWriter serializes access to a ResponseWriter so that it can be
+// flushed from outside the handler.
+type flushWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+
+	sync.Mutex
+	written bool
+}
+
+func (fw *flushWriter) WriteHeader(status int) {
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.written = true
+	return fw.ResponseWriter.Write(b)
+}
+
+func (fw *flushWriter) Flush() {
+	fw.Lock()
+	defer fw.Unlock()
+
+	fw.flusher.Flush()
+}
+
+func (fw *flushWriter) flushWritten() {
+	fw.Lock()
+	defer fw.Unlock()
+
+	if fw.written {
+		fw.flusher.Flush()
+	}
+}
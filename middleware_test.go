@@ -0,0 +1,222 @@
+package graceful
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOverloadMiddleware(t *testing.T) {
+	srv := &Server{}
+	handler := srv.OverloadMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Errorf("expected requests to pass through, got %d", rec.Code)
+	}
+
+	srv.SetOverload(true, 0, 1500*time.Millisecond)
+	rec := serve()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d while overloaded, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "2" {
+		t.Errorf("expected Retry-After 2, got %q", retry)
+	}
+
+	srv.SetOverload(true, http.StatusServiceUnavailable, 0)
+	rec = serve()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d while overloaded, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "" {
+		t.Errorf("expected no Retry-After, got %q", retry)
+	}
+
+	srv.SetOverload(false, 0, 0)
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Errorf("expected requests to pass through again, got %d", rec.Code)
+	}
+}
+
+func TestFlushMiddleware(t *testing.T) {
+	srv := &Server{}
+	written := make(chan struct{})
+	release := make(chan struct{})
+	h := srv.FlushMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("partial"))
+		close(written)
+		<-release
+	}))
+
+	rec := httptest.NewRecorder()
+	go func() {
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/stream", nil))
+	}()
+	<-written
+
+	srv.flushStreams()
+	close(release)
+	if !rec.Flushed {
+		t.Error("expected the streaming response to be flushed")
+	}
+}
+
+func TestRejectUpgradesOnShutdown(t *testing.T) {
+	srv := &Server{}
+	handler := srv.RejectUpgradesOnShutdown(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(upgrade bool) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		if upgrade {
+			r.Header.Set("Connection", "keep-alive, Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	srv.stats.setState(StateServing)
+	if code := serve(true); code != http.StatusOK {
+		t.Errorf("expected upgrades to pass through while serving, got %d", code)
+	}
+
+	srv.stats.setState(StateDraining)
+	if code := serve(true); code != http.StatusServiceUnavailable {
+		t.Errorf("expected upgrades to be rejected while draining, got %d", code)
+	}
+	if code := serve(false); code != http.StatusOK {
+		t.Errorf("expected other requests to pass through while draining, got %d", code)
+	}
+	if n := srv.DrainRejectedCount(); n != 1 {
+		t.Errorf("expected 1 request rejected while draining, got %d", n)
+	}
+}
+
+func TestDrainHeaderMiddleware(t *testing.T) {
+	srv := &Server{}
+	handler := srv.DrainHeaderMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+
+	serve := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Header().Get(DrainingHeader)
+	}
+
+	srv.stats.setState(StateServing)
+	if v := serve(); v != "" {
+		t.Errorf("expected no header while serving, got %q", v)
+	}
+
+	srv.stats.setState(StateDraining)
+	if v := serve(); v != "-1" {
+		t.Errorf("expected -1 while draining without a deadline, got %q", v)
+	}
+	srv.stats.setDrainDeadline(time.Now().Add(2500 * time.Millisecond))
+	if v := serve(); v != "3" {
+		t.Errorf("expected 3 seconds left, got %q", v)
+	}
+}
+
+// blockingWriter is a ResponseWriter whose writes block until unblock is
+// closed, like those to a slow client.
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+}
+
+func (w blockingWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestFlushMiddlewareSlowClient(t *testing.T) {
+	srv := &Server{}
+	writing := make(chan struct{})
+	slow := srv.FlushMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(writing)
+		rw.Write([]byte("stuck"))
+	}))
+	fast := srv.FlushMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("done"))
+	}))
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	go slow.ServeHTTP(blockingWriter{httptest.NewRecorder(), unblock}, httptest.NewRequest("GET", "/slow", nil))
+	<-writing
+	time.Sleep(waitTime)
+
+	// Flushing waits on the stuck write, which must not hold up other
+	// streams finishing.
+	srv.flushStreams()
+	served := make(chan struct{})
+	go func() {
+		fast.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the other stream to finish while a write is stuck")
+	}
+}
+
+// fullWriter is a ResponseWriter implementing all the optional interfaces.
+type fullWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return nil, nil, nil }
+func (fullWriter) Push(string, *http.PushOptions) error         { return nil }
+func (fullWriter) CloseNotify() <-chan bool                     { return nil }
+
+func TestMiddlewareWriterInterfaces(t *testing.T) {
+	srv := &Server{}
+	middlewares := map[string]func(http.Handler) http.Handler{
+		"DrainHeaderMiddleware": srv.DrainHeaderMiddleware,
+		"FlushMiddleware":       srv.FlushMiddleware,
+	}
+	writers := map[string]http.ResponseWriter{
+		"plain":    struct{ http.ResponseWriter }{httptest.NewRecorder()},
+		"recorder": httptest.NewRecorder(),
+		"full":     fullWriter{httptest.NewRecorder()},
+	}
+
+	for mname, middleware := range middlewares {
+		for wname, rw := range writers {
+			var got http.ResponseWriter
+			middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got = rw
+			})).ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+			_, wantF := rw.(http.Flusher)
+			_, wantH := rw.(http.Hijacker)
+			_, wantP := rw.(http.Pusher)
+			_, wantC := rw.(http.CloseNotifier)
+			_, gotF := got.(http.Flusher)
+			_, gotH := got.(http.Hijacker)
+			_, gotP := got.(http.Pusher)
+			_, gotC := got.(http.CloseNotifier)
+			if gotF != wantF || gotH != wantH || gotP != wantP || gotC != wantC {
+				t.Errorf("%s on %s writer: expected Flusher %v, Hijacker %v, Pusher %v, CloseNotifier %v, got %v, %v, %v, %v",
+					mname, wname, wantF, wantH, wantP, wantC, gotF, gotH, gotP, gotC)
+			}
+		}
+	}
+}
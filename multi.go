@@ -0,0 +1,319 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ListenerHandler pairs a listener served by ServeMultiple with the
+// handler serving its requests.
+type ListenerHandler struct {
+	Listener net.Listener
+
+	// Handler serves the requests on the Listener's connections. If nil,
+	// the http.Server's Handler serves them.
+	Handler http.Handler
+}
+
+// ErrNoListeners is returned by ServeMultiple when given no listeners.
+var ErrNoListeners = errors.New("no listeners to serve")
+
+// ServeMultiple is like Serve, but serves several listeners at once, each
+// with its own handler, e.g. a public API on one port and internal
+// endpoints on another. They share a single graceful shutdown: all the
+// listeners are closed together and their connections drained and killed
+// as one. If any of the listeners fails, Serve returns its error after
+// shutting down. Each connection is matched to its listener when accepted;
+// a request on one whose listener is unknown is answered with a 500 rather
+// than served by another listener's handler.
+func (srv *Server) ServeMultiple(pairs ...ListenerHandler) error {
+	if len(pairs) == 0 {
+		return ErrNoListeners
+	}
+	return srv.Serve(newMultiListener(pairs))
+}
+
+// multiListener accepts the connections of the listeners served by
+// ServeMultiple.
+type multiListener struct {
+	pairs    []ListenerHandler
+	accepted chan acceptResult
+
+	// removed holds the listeners closed by DrainListener, origins the
+	// listener each connection being served was accepted on, and pending
+	// that of the connection last returned by Accept until it is claimed.
+	mu      sync.Mutex
+	removed map[net.Listener]bool
+	origins map[net.Conn]*ListenerHandler
+	pending *ListenerHandler
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// acceptResult is the outcome of an Accept on one of a multiListener's
+// listeners.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+	pair *ListenerHandler
+}
+
+func newMultiListener(pairs []ListenerHandler) *multiListener {
+	l := &multiListener{
+		pairs:    pairs,
+		accepted: make(chan acceptResult),
+		removed:  make(map[net.Listener]bool),
+		origins:  make(map[net.Conn]*ListenerHandler),
+		closed:   make(chan struct{}),
+	}
+	for i := range pairs {
+		go l.accept(&l.pairs[i])
+	}
+	return l
+}
+
+// accept hands the connections accepted by the listener of pair to Accept
+// until it fails or the multiListener is closed.
+func (l *multiListener) accept(pair *ListenerHandler) {
+	ln := pair.Listener
+	for {
+		conn, err := ln.Accept()
+		// A listener closed by DrainListener leaves the others serving.
+		if err != nil && l.isRemoved(ln) {
+			return
+		}
+		select {
+		case l.accepted <- acceptResult{conn, err, pair}:
+		case <-l.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			continue
+		}
+		// Temporary errors are retried by http.Server, which has backed
+		// off by the time it took this one.
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return
+		}
+	}
+}
+
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		if r.err == nil {
+			l.mu.Lock()
+			l.pending = r.pair
+			l.mu.Unlock()
+		}
+		return r.conn, r.err
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+// Close closes all the listeners, returning the first error.
+func (l *multiListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		for _, pair := range l.pairs {
+			if l.isRemoved(pair.Listener) {
+				continue
+			}
+			if cerr := pair.Listener.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (l *multiListener) Addr() net.Addr {
+	return l.pairs[0].Listener.Addr()
+}
+
+// remove marks ln as closed by DrainListener, reporting whether it is one
+// of the listeners that was still being served.
+func (l *multiListener) remove(ln net.Listener) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, pair := range l.pairs {
+		if pair.Listener == ln && !l.removed[ln] {
+			l.removed[ln] = true
+			return true
+		}
+	}
+	return false
+}
+
+// isRemoved reports whether ln was closed by DrainListener.
+func (l *multiListener) isRemoved(ln net.Listener) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.removed[ln]
+}
+
+// handled reports whether every listener has a handler of its own.
+func (l *multiListener) handled() bool {
+	for _, pair := range l.pairs {
+		if pair.Handler == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// claim records conn as accepted on the listener of the connection last
+// returned by Accept. The listeners wrapping the multiListener in serve
+// return the connection of the last Accept or none, so claiming what the
+// outermost one returns keys the origin by the connection net/http serves,
+// however it was wrapped; connections dropped on the way are forgotten by
+// the next Accept.
+func (l *multiListener) claim(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending != nil {
+		l.origins[conn] = l.pending
+		l.pending = nil
+	}
+}
+
+// forget drops the origin of conn once it is closed or hijacked.
+func (l *multiListener) forget(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.origins, conn)
+}
+
+// origin returns the pair whose listener conn was accepted on, if known.
+func (l *multiListener) origin(conn net.Conn) (ListenerHandler, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pair, ok := l.origins[conn]
+	if !ok {
+		return ListenerHandler{}, false
+	}
+	return *pair, true
+}
+
+// originListener claims the origin of each connection it accepts from the
+// listeners wrapping a multiListener.
+type originListener struct {
+	net.Listener
+	multi *multiListener
+}
+
+func (l originListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.multi.claim(conn)
+	}
+	return conn, err
+}
+
+// listenerHandler returns the handler of the listener conn was accepted on
+// when serving several listeners, or nil if the http.Server's Handler
+// serves it. It reports false if serving several listeners and the one
+// conn was accepted on is not known.
+func (srv *Server) listenerHandler(conn net.Conn) (http.Handler, bool) {
+	srv.chanLock.RLock()
+	multi := srv.multi
+	srv.chanLock.RUnlock()
+	if multi == nil {
+		return nil, true
+	}
+	pair, ok := multi.origin(conn)
+	return pair.Handler, ok
+}
+
+// ErrListenerNotServed is returned by DrainListener for a listener that is
+// not being served by ServeMultiple.
+var ErrListenerNotServed = errors.New("listener is not served by ServeMultiple")
+
+// listenerDrain asks the connection manager to close the idle connections
+// accepted on ln, or to kill all those that may be killed if kill is set,
+// and to reply with the number of connections left on it.
+type listenerDrain struct {
+	multi *multiListener
+	ln    net.Listener
+	kill  bool
+	reply chan int
+}
+
+// from reports whether conn was accepted on the listener being drained, as
+// recorded when it was accepted.
+func (q listenerDrain) from(conn net.Conn) bool {
+	pair, ok := q.multi.origin(conn)
+	return ok && pair.Listener == q.ln
+}
+
+// DrainListener closes l, one of the listeners served by ServeMultiple, and
+// drains its connections while the others keep serving, e.g. for per-port
+// maintenance. Its connections are those accepted on it, whatever their
+// local address. The idle ones are closed and the others waited for,
+// for up to timeout if positive, after which they are killed like at
+// shutdown. A negative timeout kills them right away. DrainListener returns
+// once they are all gone, or the server has stopped.
+func (srv *Server) DrainListener(l net.Listener, timeout time.Duration) error {
+	srv.chanLock.RLock()
+	multi, managed := srv.multi, srv.managed
+	srv.chanLock.RUnlock()
+	if multi == nil || !multi.remove(l) {
+		return ErrListenerNotServed
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+
+	kill := timeout < 0
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	ticker := time.NewTicker(drainCompleteInterval)
+	defer ticker.Stop()
+	for {
+		q := listenerDrain{multi: multi, ln: l, kill: kill, reply: make(chan int, 1)}
+		select {
+		case srv.listenerDrainChan() <- q:
+		case <-managed:
+			return nil
+		}
+		if <-q.reply == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-expired:
+			kill = true
+		case <-managed:
+			return nil
+		}
+	}
+}
+
+// listenerDrainChan returns the channel the connection manager answers
+// DrainListener on.
+func (srv *Server) listenerDrainChan() chan listenerDrain {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.listenerDrains == nil {
+		srv.listenerDrains = make(chan listenerDrain)
+	}
+	return srv.listenerDrains
+}
@@ -0,0 +1,287 @@
+package graceful
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// respond returns a handler answering with body.
+func respond(body string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, body)
+	})
+}
+
+// get returns the body of the response to a GET of url.
+func get(t *testing.T, url string) string {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the body failed: %v", err)
+	}
+	return string(body)
+}
+
+func TestServeMultiple(t *testing.T) {
+	public, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every listener has its own handler, so the http.Server needs none.
+	srv := &Server{Timeout: killTime, Server: &http.Server{}, NoSignalHandling: true}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ServeMultiple(
+			ListenerHandler{Listener: public, Handler: respond("public")},
+			ListenerHandler{Listener: internal, Handler: respond("internal")},
+		)
+	}()
+	time.Sleep(waitTime)
+
+	if body := get(t, fmt.Sprintf("http://localhost:%d", port)); body != "public" {
+		t.Errorf("expected the public handler, got %q", body)
+	}
+	if body := get(t, "http://"+internal.Addr().String()); body != "internal" {
+		t.Errorf("expected the internal handler, got %q", body)
+	}
+
+	srv.Stop(killTime)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("expected ServeMultiple to return")
+	}
+
+	// Both listeners are closed.
+	if _, err := net.Dial("tcp", internal.Addr().String()); err == nil {
+		t.Error("expected the internal listener to be closed")
+	}
+}
+
+// getConn returns the body of the response to a GET sent over conn.
+func getConn(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	if _, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+		t.Fatalf("writing the request failed: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading the response failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the body failed: %v", err)
+	}
+	return string(body)
+}
+
+func TestServeMultipleSameAddress(t *testing.T) {
+	// Both listeners report the same address, so connections can only be
+	// told apart by the listener they were accepted on.
+	first := newPipeListener()
+	second := newPipeListener()
+
+	srv := &Server{Timeout: killTime, Server: &http.Server{}, NoSignalHandling: true}
+	go srv.ServeMultiple(
+		ListenerHandler{Listener: first, Handler: respond("first")},
+		ListenerHandler{Listener: second, Handler: respond("second")},
+	)
+	defer func() {
+		srv.Stop(killTime)
+		<-srv.StopChan()
+	}()
+
+	for _, tc := range []struct {
+		l    *pipeListener
+		want string
+	}{{second, "second"}, {first, "first"}, {second, "second"}} {
+		conn, err := tc.l.Dial("pipe", "pipe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := getConn(t, conn); body != tc.want {
+			t.Errorf("expected the %s handler, got %q", tc.want, body)
+		}
+		conn.Close()
+	}
+}
+
+func TestServeMultipleDefaultHandler(t *testing.T) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: &http.Server{Handler: respond("default")}, NoSignalHandling: true}
+	go srv.ServeMultiple(ListenerHandler{Listener: l})
+	time.Sleep(waitTime)
+
+	if body := get(t, fmt.Sprintf("http://localhost:%d", port)); body != "default" {
+		t.Errorf("expected the http.Server's handler, got %q", body)
+	}
+	srv.Stop(killTime)
+	<-srv.StopChan()
+}
+
+func TestServeMultipleWithoutListeners(t *testing.T) {
+	srv := &Server{Server: &http.Server{}, NoSignalHandling: true}
+	if err := srv.ServeMultiple(); err != ErrNoListeners {
+		t.Errorf("expected ErrNoListeners, got %v", err)
+	}
+}
+
+func TestDrainListener(t *testing.T) {
+	drained, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: &http.Server{Handler: respond("ok")}, NoSignalHandling: true}
+	go srv.ServeMultiple(ListenerHandler{Listener: drained}, ListenerHandler{Listener: other})
+	defer func() {
+		srv.Stop(killTime)
+		<-srv.StopChan()
+	}()
+	time.Sleep(waitTime)
+
+	// The keep-alive connection is idle once the response is read.
+	get(t, fmt.Sprintf("http://localhost:%d", port))
+
+	start := time.Now()
+	if err := srv.DrainListener(drained, killTime); err != nil {
+		t.Fatalf("DrainListener failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= killTime {
+		t.Errorf("expected the idle connection to be closed right away, took %s", elapsed)
+	}
+	if snap := srv.Snapshot(); snap.KilledConnections != 0 {
+		t.Errorf("expected no connection to be killed, got %d", snap.KilledConnections)
+	}
+
+	if _, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port)); err == nil {
+		t.Error("expected the drained listener to be closed")
+	}
+	if body := get(t, "http://"+other.Addr().String()); body != "ok" {
+		t.Errorf("expected the other listener to keep serving, got %q", body)
+	}
+	if err := srv.DrainListener(drained, killTime); err != ErrListenerNotServed {
+		t.Errorf("expected ErrListenerNotServed draining twice, got %v", err)
+	}
+}
+
+func TestDrainListenerTimeout(t *testing.T) {
+	server, drained, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+	go srv.ServeMultiple(ListenerHandler{Listener: drained}, ListenerHandler{Listener: other, Handler: respond("ok")})
+	defer func() {
+		srv.Stop(killTime)
+		<-srv.StopChan()
+	}()
+	time.Sleep(waitTime)
+
+	go func() {
+		client := &http.Client{Transport: &http.Transport{}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	if err := srv.DrainListener(drained, killTime/2); err != nil {
+		t.Fatalf("DrainListener failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < killTime/2 || elapsed > killTime {
+		t.Errorf("expected the active connection to be killed after %s, took %s", killTime/2, elapsed)
+	}
+	if snap := srv.Snapshot(); snap.KilledConnections != 1 {
+		t.Errorf("expected the active connection to be killed, got %d", snap.KilledConnections)
+	}
+	if body := get(t, "http://"+other.Addr().String()); body != "ok" {
+		t.Errorf("expected the other listener to keep serving, got %q", body)
+	}
+}
+
+func TestDrainListenerSameAddress(t *testing.T) {
+	// Both listeners report the same address, so only the listener each
+	// connection was accepted on tells which ones to drain.
+	drained := newPipeListener()
+	other := newPipeListener()
+
+	slow := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(killTime * 10)
+	})
+	srv := &Server{Timeout: killTime, Server: &http.Server{Handler: slow}, NoSignalHandling: true}
+	go srv.ServeMultiple(ListenerHandler{Listener: drained}, ListenerHandler{Listener: other})
+	defer func() {
+		srv.Stop(killTime)
+		<-srv.StopChan()
+	}()
+
+	for _, l := range []*pipeListener{other, drained} {
+		conn, err := l.Dial("pipe", "pipe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+	}
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	if err := srv.DrainListener(drained, killTime/2); err != nil {
+		t.Fatalf("DrainListener failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < killTime/2 || elapsed > killTime {
+		t.Errorf("expected the active connection to be killed after %s, took %s", killTime/2, elapsed)
+	}
+	if snap := srv.Snapshot(); snap.KilledConnections != 1 || snap.Connections != 1 {
+		t.Errorf("expected only the drained listener's connection to be killed, got %d killed and %d open",
+			snap.KilledConnections, snap.Connections)
+	}
+}
+
+func TestDrainListenerNotServed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &Server{Server: &http.Server{}, NoSignalHandling: true}
+	if err := srv.DrainListener(l, killTime); err != ErrListenerNotServed {
+		t.Errorf("expected ErrListenerNotServed, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package graceful
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Option configures a Server created by New. Each option sets the Server
+// field of the same name, so New(s, WithTimeout(d)) is equivalent to
+// setting Timeout on a Server built with FromHTTPServer.
+type Option func(*Server)
+
+// New returns a Server that gracefully shuts down server, configured by
+// opts. Like FromHTTPServer, it logs with DefaultLogger unless told
+// otherwise and takes over a ConnState set on server.
+func New(server *http.Server, opts ...Option) *Server {
+	srv := FromHTTPServer(server, 0)
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
+}
+
+// WithTimeout sets how long to wait for active requests before killing
+// them. See Timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(srv *Server) {
+		srv.Timeout = timeout
+	}
+}
+
+// WithLogger sets the Logger, which may be nil to disable logging.
+func WithLogger(logger *log.Logger) Option {
+	return func(srv *Server) {
+		srv.Logger = logger
+	}
+}
+
+// WithSignals sets whether SIGINT and SIGTERM shut the server down. See
+// NoSignalHandling.
+func WithSignals(enabled bool) Option {
+	return func(srv *Server) {
+		srv.NoSignalHandling = !enabled
+	}
+}
+
+// WithSignalModes sets how the server shuts down on each signal. See
+// SignalModes.
+func WithSignalModes(modes map[os.Signal]ShutdownMode) Option {
+	return func(srv *Server) {
+		srv.SignalModes = modes
+	}
+}
+
+// WithBeforeShutdown sets the BeforeShutdown hook.
+func WithBeforeShutdown(f func() bool) Option {
+	return func(srv *Server) {
+		srv.BeforeShutdown = f
+	}
+}
+
+// WithShutdownInitiated sets the ShutdownInitiated hook.
+func WithShutdownInitiated(f func()) Option {
+	return func(srv *Server) {
+		srv.ShutdownInitiated = f
+	}
+}
+
+// WithConnState sets the ConnState hook.
+func WithConnState(f func(net.Conn, http.ConnState)) Option {
+	return func(srv *Server) {
+		srv.ConnState = f
+	}
+}
@@ -0,0 +1,46 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var moved bool
+	server := &http.Server{ConnState: func(net.Conn, http.ConnState) { moved = true }}
+	before := func() bool { return true }
+	srv := New(server,
+		WithTimeout(killTime),
+		WithLogger(nil),
+		WithSignals(false),
+		WithBeforeShutdown(before),
+	)
+
+	if srv.Server != server {
+		t.Error("expected the http.Server to be used")
+	}
+	if srv.Timeout != killTime {
+		t.Errorf("expected Timeout %s, got %s", killTime, srv.Timeout)
+	}
+	if srv.Logger != nil {
+		t.Error("expected the Logger to be cleared")
+	}
+	if !srv.NoSignalHandling {
+		t.Error("expected signal handling to be disabled")
+	}
+	if srv.BeforeShutdown == nil || !srv.BeforeShutdown() {
+		t.Error("expected BeforeShutdown to be set")
+	}
+	if server.ConnState != nil || srv.ConnState == nil {
+		t.Fatal("expected ConnState to be moved to the Server")
+	}
+	srv.ConnState(nil, http.StateNew)
+	if !moved {
+		t.Error("expected the moved ConnState to be called")
+	}
+
+	if srv := New(&http.Server{}); srv.Logger == nil || srv.Timeout != 0 {
+		t.Error("expected New without options to match FromHTTPServer")
+	}
+}
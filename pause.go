@@ -0,0 +1,102 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// pause is the accept pausing state set by PauseAccept and ResumeAccept.
+type pause struct {
+	sync.Mutex
+	paused bool
+
+	// resumed is closed when accepting resumes.
+	resumed chan struct{}
+}
+
+// PauseAccept stops the server from serving new connections until
+// ResumeAccept is called. Connections made meanwhile are held, unserved,
+// rather than refused. Connections already being served are unaffected.
+func (srv *Server) PauseAccept() {
+	srv.pause.Lock()
+	defer srv.pause.Unlock()
+
+	if !srv.pause.paused {
+		srv.pause.paused = true
+		srv.pause.resumed = make(chan struct{})
+	}
+}
+
+// ResumeAccept undoes PauseAccept, serving held and new connections again.
+func (srv *Server) ResumeAccept() {
+	srv.pause.Lock()
+	defer srv.pause.Unlock()
+
+	if srv.pause.paused {
+		srv.pause.paused = false
+		close(srv.pause.resumed)
+	}
+}
+
+// resumed returns a channel that is closed when accepting resumes, or nil
+// if accepting isn't paused.
+func (srv *Server) resumed() chan struct{} {
+	srv.pause.Lock()
+	defer srv.pause.Unlock()
+
+	if !srv.pause.paused {
+		return nil
+	}
+	return srv.pause.resumed
+}
+
+// errListenerClosed is returned by Accept on a pauseListener that was
+// closed while accepting was paused, and on a closed multiListener.
+var errListenerClosed = errors.New("listener closed")
+
+// pauseListener holds accepted connections while accepting is paused.
+type pauseListener struct {
+	net.Listener
+	srv       *Server
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (srv *Server) pauseListener(l net.Listener) net.Listener {
+	return &pauseListener{Listener: l, srv: srv, closed: make(chan struct{})}
+}
+
+func (l *pauseListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := l.srv.resumed()
+	if resumed == nil {
+		return c, nil
+	}
+	if l.srv.OnPause != nil {
+		l.srv.OnPause()
+	}
+	for resumed != nil {
+		select {
+		case <-resumed:
+		case <-l.closed:
+			c.Close()
+			return nil, errListenerClosed
+		}
+		// Accepting may have been paused again in the meantime.
+		resumed = l.srv.resumed()
+	}
+	if l.srv.OnResume != nil {
+		l.srv.OnResume()
+	}
+	return c, nil
+}
+
+func (l *pauseListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
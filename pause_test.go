@@ -0,0 +1,90 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPauseAccept(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pauses, resumes int32
+	srv := &Server{
+		Server:           server,
+		OnPause:          func() { atomic.AddInt32(&pauses, 1) },
+		OnResume:         func() { atomic.AddInt32(&resumes, 1) },
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	srv.PauseAccept()
+	if srv.Snapshot().Accepting {
+		t.Error("expected the snapshot not to be accepting while paused")
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	select {
+	case <-served:
+		t.Fatal("expected the request to be held while paused")
+	case <-time.After(waitTime):
+	}
+	if n := atomic.LoadInt32(&pauses); n != 1 {
+		t.Errorf("expected OnPause to be called once, got %d", n)
+	}
+
+	srv.ResumeAccept()
+	select {
+	case <-served:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the held request to be served")
+	}
+	if n := atomic.LoadInt32(&resumes); n != 1 {
+		t.Errorf("expected OnResume to be called once, got %d", n)
+	}
+}
+
+func TestPauseAcceptStop(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	srv.PauseAccept()
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	// Stopping must not wait for accepting to resume.
+	srv.Stop(0)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for a paused server to stop")
+	}
+}
@@ -0,0 +1,28 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePidFile writes the process ID to PidFile, replacing a stale one.
+func (srv *Server) writePidFile() error {
+	return ioutil.WriteFile(srv.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes PidFile, unless it has since been taken over by
+// another process, such as the one started by RestartWithExec.
+func (srv *Server) removePidFile() {
+	b, err := ioutil.ReadFile(srv.PidFile)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(srv.PidFile); err != nil {
+		srv.logw(LevelError, map[string]interface{}{"error": err}, "%s", err)
+	}
+}
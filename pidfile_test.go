@@ -0,0 +1,70 @@
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "server.pid")
+	if err := ioutil.WriteFile(pidFile, []byte("99999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, PidFile: pidFile, NoSignalHandling: true}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+	time.Sleep(waitTime)
+
+	b, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid := strings.TrimSpace(string(b)); pid != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected the stale pidfile to be replaced, got pid %s", pid)
+	}
+
+	srv.Stop(0)
+	<-served
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("expected the pidfile to be removed, got %v", err)
+	}
+
+	// Serve removes it when failing too.
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = &Server{Server: &http.Server{}, PidFile: pidFile, NoSignalHandling: true}
+	if err := srv.Serve(l); err != ErrNoHandler {
+		t.Errorf("expected ErrNoHandler, got %v", err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("expected the pidfile to be removed after an error, got %v", err)
+	}
+
+	// A pidfile taken over by another process is left alone.
+	if err := ioutil.WriteFile(pidFile, []byte("99999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.removePidFile()
+	if _, err := os.Stat(pidFile); err != nil {
+		t.Errorf("expected another process's pidfile to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package graceful
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// connQuota counts the tracked connections of each remote IP for
+// MaxConnsPerIP.
+type connQuota struct {
+	sync.Mutex
+	counts map[string]int
+	conns  map[net.Conn]string
+}
+
+// admit records conn as coming from ip unless ip already has limit
+// connections, reporting whether it did.
+func (q *connQuota) admit(conn net.Conn, ip string, limit int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.counts[ip] >= limit {
+		return false
+	}
+	if q.counts == nil {
+		q.counts = make(map[string]int)
+		q.conns = make(map[net.Conn]string)
+	}
+	q.counts[ip]++
+	q.conns[conn] = ip
+	return true
+}
+
+// release forgets conn once it is closed or hijacked.
+func (q *connQuota) release(conn net.Conn) {
+	q.Lock()
+	defer q.Unlock()
+
+	ip, ok := q.conns[conn]
+	if !ok {
+		return
+	}
+	delete(q.conns, conn)
+	if q.counts[ip]--; q.counts[ip] <= 0 {
+		delete(q.counts, ip)
+	}
+}
+
+// atQuota reports whether conn comes from an IP that has used up its quota.
+func (q *connQuota) atQuota(conn net.Conn, limit int) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	ip, ok := q.conns[conn]
+	return ok && q.counts[ip] >= limit
+}
+
+// quotaListener closes connections from remote IPs that already have
+// MaxConnsPerIP connections.
+type quotaListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l quotaListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		ip := remoteIP(conn.RemoteAddr())
+		if ip == nil || l.srv.connQuota.admit(conn, ip.String(), l.srv.MaxConnsPerIP) {
+			return conn, nil
+		}
+		l.srv.logw(LevelWarn, map[string]interface{}{"remote": conn.RemoteAddr().String()}, "rejected connection from %s: too many connections", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// orderQuota moves the connections from IPs that have used up their
+// MaxConnsPerIP quota to the front of conns, keeping the order otherwise.
+func (srv *Server) orderQuota(conns []net.Conn) {
+	if srv.MaxConnsPerIP <= 0 {
+		return
+	}
+	at := make(map[net.Conn]bool, len(conns))
+	for _, conn := range conns {
+		at[conn] = srv.connQuota.atQuota(conn, srv.MaxConnsPerIP)
+	}
+	sort.SliceStable(conns, func(i, j int) bool {
+		return at[conns[i]] && !at[conns[j]]
+	})
+}
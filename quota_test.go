@@ -0,0 +1,84 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaxConnsPerIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		MaxConnsPerIP:    1,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	defer srv.Stop(0)
+	time.Sleep(waitTime)
+
+	// rejected reports whether a new connection is closed by the server.
+	rejected := func() (net.Conn, bool) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(waitTime))
+		_, err = conn.Read(make([]byte, 1))
+		ne, ok := err.(net.Error)
+		return conn, !ok || !ne.Timeout()
+	}
+
+	first, closed := rejected()
+	if closed {
+		t.Fatal("expected the first connection to be served")
+	}
+	if second, closed := rejected(); !closed {
+		second.Close()
+		t.Error("expected a second connection from the same IP to be closed")
+	}
+
+	first.Close()
+	time.Sleep(waitTime)
+	third, closed := rejected()
+	if closed {
+		t.Error("expected a connection to be served once the first one closed")
+	}
+	third.Close()
+}
+
+func TestManagerKillsOverQuotaFirst(t *testing.T) {
+	closed := make(chan net.Conn, 3)
+	h := newManagerHarness(&Server{
+		Server:        &http.Server{},
+		MaxConnsPerIP: 2,
+		KillRate:      1000,
+		KillOrder:     KillOldest,
+		CloseConn: func(conn net.Conn) error {
+			closed <- conn
+			return conn.Close()
+		},
+	})
+	var conns []net.Conn
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.2"} {
+		client, conn := h.conn()
+		defer client.Close()
+		h.srv.connQuota.admit(conn, ip, h.srv.MaxConnsPerIP)
+		conns = append(conns, conn)
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{}, 1)
+	h.shutdown <- done
+	close(h.kill)
+	h.expectDone(t, done)
+	for _, i := range []int{1, 2, 0} {
+		if conn := <-closed; conn != conns[i] {
+			t.Errorf("expected connection %d to be closed next", i)
+		}
+	}
+}
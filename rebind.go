@@ -0,0 +1,80 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+)
+
+// rebindListener replaces the listener created by ListenAndServe and
+// ListenAndServeTLS when it fails, up to RebindOnFailure times, so that
+// serving resumes on the same address.
+type rebindListener struct {
+	srv  *Server
+	addr string
+
+	mu     sync.Mutex
+	ln     net.Listener
+	closed bool
+	left   int
+}
+
+func (srv *Server) rebindListener(ln net.Listener) *rebindListener {
+	return &rebindListener{srv: srv, addr: ln.Addr().String(), ln: ln, left: srv.RebindOnFailure}
+}
+
+func (l *rebindListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		ln := l.ln
+		l.mu.Unlock()
+
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		// Temporary errors are retried by http.Server.
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			return nil, err
+		}
+		if !l.rebind(ln, err) {
+			return nil, err
+		}
+	}
+}
+
+// rebind replaces failed, which returned err, with a new listener on the
+// same address and reports whether serving may go on.
+func (l *rebindListener) rebind(failed net.Listener, err error) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || l.left == 0 {
+		return false
+	}
+	l.left--
+	l.srv.logw(LevelWarn, map[string]interface{}{"error": err, "addr": l.addr}, "listener on %s failed, rebinding: %s", l.addr, err)
+	failed.Close()
+
+	ln, lerr := l.srv.bindTCP(l.addr)
+	if lerr != nil {
+		l.srv.logw(LevelError, map[string]interface{}{"error": lerr, "addr": l.addr}, "rebinding %s failed: %s", l.addr, lerr)
+		return false
+	}
+	l.ln = ln
+	return true
+}
+
+func (l *rebindListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+	return l.ln.Close()
+}
+
+func (l *rebindListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ln.Addr()
+}
@@ -0,0 +1,72 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRebindOnFailure(t *testing.T) {
+	srv := &Server{
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()},
+		RebindOnFailure:  1,
+		NoSignalHandling: true,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	time.Sleep(waitTime)
+
+	// fail closes the listener behind graceful's back.
+	fail := func() net.Addr {
+		srv.chanLock.RLock()
+		l := srv.restartListener
+		srv.chanLock.RUnlock()
+		l.Close()
+		time.Sleep(waitTime)
+		return l.Addr()
+	}
+
+	addr := fail()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatalf("expected the listener to be rebound: %v", err)
+	}
+	resp.Body.Close()
+
+	fail()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected an error once the rebinds were used up")
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("expected Serve to return once the rebinds were used up")
+	}
+}
+
+func TestRebindOnFailureShutdown(t *testing.T) {
+	srv := &Server{
+		Server:           &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()},
+		RebindOnFailure:  1,
+		NoSignalHandling: true,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected a shutdown not to be taken for a failure: %v", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for shutdown")
+	}
+}
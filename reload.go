@@ -0,0 +1,136 @@
+package graceful
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// ErrNoHandlerFactory is returned by ReloadHandler when HandlerFactory is
+// not set.
+var ErrNoHandlerFactory = errors.New("no HandlerFactory configured")
+
+// ErrNotServing is returned by ReloadHandler when the server is not serving.
+var ErrNotServing = errors.New("server is not serving")
+
+// ReloadHandler replaces the handler serving new requests with one built by
+// HandlerFactory. Requests in flight finish with the old handler. If
+// HandlerFactory fails, the current handler is kept and the error is
+// returned.
+func (srv *Server) ReloadHandler() error {
+	if srv.HandlerFactory == nil {
+		return ErrNoHandlerFactory
+	}
+	tracker, ok := srv.tracker.Load().(*requestTracker)
+	if !ok || srv.Snapshot().State == StateStopped {
+		return ErrNotServing
+	}
+
+	h, err := srv.HandlerFactory()
+	if err != nil {
+		return err
+	}
+	return srv.swapHandler(tracker, h)
+}
+
+// WarmReload replaces the handler serving new requests with h, leaving the
+// listener and connections untouched. Requests in flight finish with the
+// old handler, after which OnHandlerRetired, if set, is called with it,
+// e.g. to release the resources it holds.
+func (srv *Server) WarmReload(h http.Handler) error {
+	tracker, ok := srv.tracker.Load().(*requestTracker)
+	if !ok || srv.Snapshot().State == StateStopped {
+		return ErrNotServing
+	}
+	return srv.swapHandler(tracker, h)
+}
+
+// swapHandler installs h as the handler serving new requests of tracker
+// and retires the one it replaces.
+func (srv *Server) swapHandler(tracker *requestTracker, h http.Handler) error {
+	if h == nil && !srv.AllowDefaultMux {
+		return ErrNoHandler
+	}
+
+	srv.swapLock.Lock()
+	defer srv.swapLock.Unlock()
+
+	old := tracker.current.Load().(handlerValue)
+	tracker.current.Store(handlerValue{h, &handlerGen{}})
+	old.gen.retire(func() {
+		if srv.OnHandlerRetired != nil {
+			srv.OnHandlerRetired(old.Handler)
+		}
+	})
+	return nil
+}
+
+// handlerGen counts the requests served by one handler, so that it can be
+// retired once they have all finished.
+type handlerGen struct {
+	sync.Mutex
+	n       int
+	retired func()
+	done    bool
+}
+
+// acquire counts a request, unless the handler has already been retired
+// and drained.
+func (g *handlerGen) acquire() bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.done {
+		return false
+	}
+	g.n++
+	return true
+}
+
+// release uncounts a request, running the retirement once the last one
+// finishes.
+func (g *handlerGen) release() {
+	g.Lock()
+	defer g.Unlock()
+
+	g.n--
+	g.finish()
+}
+
+// retire runs retired in the background once no more requests are being
+// served.
+func (g *handlerGen) retire(retired func()) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.retired = retired
+	g.finish()
+}
+
+// finish runs the retirement if it is due. g must be locked.
+func (g *handlerGen) finish() {
+	if g.retired == nil || g.n > 0 || g.done {
+		return
+	}
+	g.done = true
+	go g.retired()
+}
+
+// handleReload reloads the handler on each signal received until shutdown
+// begins.
+func (srv *Server) handleReload(reload chan os.Signal, quitting chan struct{}) {
+	defer signalStop(reload)
+	for {
+		select {
+		case <-reload:
+			if err := srv.ReloadHandler(); err != nil {
+				srv.logw(LevelError, map[string]interface{}{"error": err}, "reloading handler: %s", err)
+				continue
+			}
+			srv.logf("handler reloaded")
+		case <-quitting:
+			return
+		}
+	}
+}
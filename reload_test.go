@@ -0,0 +1,164 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadHandler(t *testing.T) {
+	_, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version := 0
+	srv := &Server{
+		Server: &http.Server{Handler: versionHandler(version)},
+		HandlerFactory: func() (http.Handler, error) {
+			if version == 2 {
+				return nil, errors.New("bad config")
+			}
+			version++
+			return versionHandler(version), nil
+		},
+		NoSignalHandling: true,
+	}
+	if err := srv.ReloadHandler(); err != ErrNotServing {
+		t.Errorf("expected ErrNotServing before serving, got %v", err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	expectVersion(t, "0")
+	if err := srv.ReloadHandler(); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, "1")
+	if err := srv.ReloadHandler(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ReloadHandler(); err == nil {
+		t.Error("expected the factory error")
+	}
+	expectVersion(t, "2")
+}
+
+func TestWarmReload(t *testing.T) {
+	_, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(rw, "slow")
+	})
+	retired := make(chan http.Handler, 1)
+	srv := &Server{
+		Server:           &http.Server{Handler: slow},
+		OnHandlerRetired: func(old http.Handler) { retired <- old },
+		NoSignalHandling: true,
+	}
+	if err := srv.WarmReload(versionHandler(1)); err != ErrNotServing {
+		t.Errorf("expected ErrNotServing before serving, got %v", err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err == nil {
+			resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+	time.Sleep(waitTime)
+
+	if err := srv.WarmReload(versionHandler(1)); err != nil {
+		t.Fatal(err)
+	}
+	expectVersion(t, "1")
+	select {
+	case <-retired:
+		t.Fatal("expected the old handler to be retired only once drained")
+	case <-time.After(waitTime):
+	}
+
+	close(release)
+	if err := <-inFlight; err != nil {
+		t.Fatalf("expected the request in flight to complete: %v", err)
+	}
+	select {
+	case <-retired:
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the old handler to be retired")
+	}
+}
+
+func TestForwardReloads(t *testing.T) {
+	_, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{
+		Server:           &http.Server{Handler: versionHandler(0)},
+		HandlerFactory:   func() (http.Handler, error) { return versionHandler(1), nil },
+		NoSignalHandling: true,
+	}
+	// Servers without a HandlerFactory or not serving are left alone.
+	idle := &Server{Server: &http.Server{}, HandlerFactory: srv.HandlerFactory}
+	plain := &Server{Server: &http.Server{}}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	reload := make(chan os.Signal)
+	go forwardReloads(reload, []*Server{idle, plain, srv})
+	reload <- os.Interrupt
+	close(reload)
+	time.Sleep(waitTime)
+	expectVersion(t, "1")
+}
+
+func versionHandler(version int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, version)
+	})
+}
+
+func expectVersion(t *testing.T, expected string) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected handler version %s, got %s", expected, b)
+	}
+}
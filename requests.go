@@ -0,0 +1,298 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// request is a request being served on a tracked connection.
+type request struct {
+	conn net.Conn
+	*http.Request
+
+	// critical is 1 once the request has been marked by MarkCritical.
+	critical int32
+
+	// started is when the handler began serving the request.
+	started time.Time
+}
+
+// RequestIDHeader is the request header KilledRequest.RequestID is taken
+// from.
+const RequestIDHeader = "X-Request-Id"
+
+// KilledRequest identifies a request interrupted because its connection was
+// killed when Timeout expired, so that operators can reconcile whether it
+// was processed.
+type KilledRequest struct {
+	Method string
+	Path   string
+
+	// RequestID is the value of the RequestIDHeader, if any.
+	RequestID string
+
+	// Started is when the handler began serving the request.
+	Started time.Time
+}
+
+// reportKilled calls OnRequestKilled for each request in flight on conn.
+// It must only be called by the connection manager.
+func (srv *Server) reportKilled(conn net.Conn) {
+	if srv.OnRequestKilled == nil {
+		return
+	}
+	for req := range srv.requests[conn] {
+		srv.OnRequestKilled(KilledRequest{
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			RequestID: req.Header.Get(RequestIDHeader),
+			Started:   req.started,
+		})
+	}
+}
+
+// MarkCritical marks the request r as critical, so that its connection is
+// not killed when Timeout expires and the drain waits for the handler to
+// return, however long it takes. The mark lasts until the handler returns.
+// It must be called before Timeout expires to take effect, and has no
+// effect on requests not served by a graceful Server.
+func MarkCritical(r *http.Request) {
+	if req, ok := r.Context().Value(requestContextKey).(*request); ok {
+		atomic.StoreInt32(&req.critical, 1)
+	}
+}
+
+// requestTracker is the Handler installed by Serve. It tells the connection
+// manager which requests each connection is serving. Once the manager has
+// exited, requests are no longer reported. Requests that may be killed
+// report the drain deadline as their context's deadline once the server is
+// draining, even if they started before.
+type requestTracker struct {
+	srv               *Server
+	started, finished chan *request
+	managed           chan struct{}
+
+	// inFlight limits the requests handled at once.
+	inFlight *inFlight
+
+	// current holds the handlerValue serving new requests, which
+	// ReloadHandler and WarmReload may replace.
+	current atomic.Value
+}
+
+// handlerValue wraps an http.Handler, which may be nil, for an atomic.Value.
+type handlerValue struct {
+	http.Handler
+
+	// gen counts the requests the handler is serving.
+	gen *handlerGen
+}
+
+// trackRequests wraps handler in a requestTracker.
+func (srv *Server) trackRequests(handler http.Handler, started, finished chan *request, managed chan struct{}) *requestTracker {
+	t := &requestTracker{srv: srv, started: started, finished: finished, managed: managed, inFlight: srv.newInFlight()}
+	t.current.Store(handlerValue{handler, &handlerGen{}})
+	return t
+}
+
+// handler returns the handler serving new requests.
+func (t *requestTracker) handler() http.Handler {
+	return t.current.Load().(handlerValue).Handler
+}
+
+// acquire returns the handlerValue serving new requests, counting the
+// request about to be served by it until it is released.
+func (t *requestTracker) acquire() handlerValue {
+	for {
+		v := t.current.Load().(handlerValue)
+		if v.gen.acquire() {
+			return v
+		}
+	}
+}
+
+func (t *requestTracker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	v := t.acquire()
+	defer v.gen.release()
+	handler := v.Handler
+	if conn, ok := ConnFromContext(r.Context()); ok {
+		h, ok := t.srv.listenerHandler(conn)
+		if !ok {
+			// The http.Server's Handler, or http.DefaultServeMux, may not
+			// be meant for every listener.
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if h != nil {
+			handler = h
+		}
+	}
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	if t.srv.killable(r) {
+		r = r.WithContext(drainDeadlineContext{r.Context(), t.srv})
+	}
+	if !t.inFlight.admit(rw, r) {
+		return
+	}
+	defer t.inFlight.release()
+	defer t.srv.stats.requestDone()
+
+	conn, ok := ConnFromContext(r.Context())
+	if !ok {
+		handler.ServeHTTP(rw, r)
+		return
+	}
+
+	req := &request{conn: conn, started: time.Now()}
+	r = r.WithContext(context.WithValue(r.Context(), requestContextKey, req))
+	req.Request = r
+	select {
+	case t.started <- req:
+	case <-t.managed:
+	}
+	defer func() {
+		select {
+		case t.finished <- req:
+		case <-t.managed:
+		}
+	}()
+
+	handler.ServeHTTP(rw, r)
+}
+
+// drainDeadlineContext is the context of a request that may be killed when
+// Timeout expires. Its deadline is the drain deadline once the server is
+// draining, if that is earlier than its own. It needs no timer of its own:
+// the connection context it derives from is cancelled when the connection
+// is killed.
+type drainDeadlineContext struct {
+	context.Context
+	srv *Server
+}
+
+func (c drainDeadlineContext) Deadline() (time.Time, bool) {
+	deadline, ok := c.Context.Deadline()
+	if drain, draining := c.srv.stats.deadline(); draining && (!ok || drain.Before(deadline)) {
+		return drain, true
+	}
+	return deadline, ok
+}
+
+// inFlight limits the number of requests handled at once according to
+// MaxInFlight and MaxQueue. Each Serve has its own, so that requests left
+// over from an earlier one return their tokens to the limit they took
+// them from.
+type inFlight struct {
+	// sem holds a token for each request being handled, or is nil if the
+	// number isn't limited.
+	sem chan struct{}
+
+	// maxQueue is the MaxQueue the inFlight was created with.
+	maxQueue int
+
+	// queued is the number of requests waiting for a token.
+	queued int32
+}
+
+// newInFlight returns the inFlight for a Serve.
+func (srv *Server) newInFlight() *inFlight {
+	f := &inFlight{maxQueue: srv.MaxQueue}
+	if srv.MaxInFlight > 0 {
+		f.sem = make(chan struct{}, srv.MaxInFlight)
+	}
+	return f
+}
+
+// admit waits for the request to be allowed to proceed according to
+// MaxInFlight and MaxQueue. Requests that may not are answered with 503
+// Service Unavailable, or dropped if the client has gone away, and admit
+// returns false.
+func (f *inFlight) admit(rw http.ResponseWriter, r *http.Request) bool {
+	if f.sem == nil {
+		return true
+	}
+	select {
+	case f.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	defer atomic.AddInt32(&f.queued, -1)
+	if int(atomic.AddInt32(&f.queued, 1)) > f.maxQueue {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return false
+	}
+	select {
+	case f.sem <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release frees the token taken by admit.
+func (f *inFlight) release() {
+	if f.sem != nil {
+		<-f.sem
+	}
+}
+
+// userHandler returns the http.Server's Handler, looking through a
+// requestTracker left installed by an earlier shutdown that killed
+// connections.
+func (srv *Server) userHandler() http.Handler {
+	if t, ok := srv.Server.Handler.(*requestTracker); ok {
+		return t.handler()
+	}
+	return srv.Server.Handler
+}
+
+// isExempt reports whether r is for one of the ExemptPaths. Paths ending
+// in a slash match all paths below them.
+func (srv *Server) isExempt(r *http.Request) bool {
+	for _, path := range srv.ExemptPaths {
+		if r.URL.Path == path || strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// killable reports whether a connection serving r may be killed when
+// Timeout expires, unless r is marked critical.
+func (srv *Server) killable(r *http.Request) bool {
+	if srv.isExempt(r) {
+		return false
+	}
+	return !srv.KillIdempotentOnly || isSafeMethod(r.Method)
+}
+
+// spared reports whether conn must not be killed when Timeout expires
+// because it is serving a request that should be allowed to complete.
+func (srv *Server) spared(conn net.Conn) bool {
+	for req := range srv.requests[conn] {
+		if atomic.LoadInt32(&req.critical) == 1 {
+			return true
+		}
+		if !srv.killable(req.Request) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSafeMethod reports whether method is one that doesn't modify state on
+// the server, so that a request using it can be interrupted safely.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
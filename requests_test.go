@@ -0,0 +1,84 @@
+package graceful
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	srv := &Server{MaxInFlight: 1, MaxQueue: 1}
+	managed := make(chan struct{})
+	close(managed)
+
+	release := make(chan struct{})
+	handler := srv.trackRequests(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}), nil, nil, managed)
+
+	codes := make(chan int, 3)
+	serve := func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		codes <- rec.Code
+	}
+
+	// The first request is handled, the second queued and the third
+	// rejected.
+	go serve()
+	time.Sleep(waitTime / 2)
+	go serve()
+	time.Sleep(waitTime / 2)
+	go serve()
+
+	select {
+	case code := <-codes:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("expected the request beyond the queue to be rejected, got %d", code)
+		}
+	case <-time.After(waitTime):
+		t.Fatal("expected the request beyond the queue to be rejected right away")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected the admitted requests to be served, got %d", code)
+		}
+	}
+}
+
+func TestMaxInFlightAcrossServes(t *testing.T) {
+	srv := &Server{MaxInFlight: 1}
+	managed := make(chan struct{})
+	close(managed)
+
+	release := make(chan struct{})
+	blocking := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	earlier := srv.trackRequests(blocking, nil, nil, managed)
+	served := make(chan struct{})
+	go func() {
+		earlier.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(served)
+	}()
+	time.Sleep(waitTime / 2)
+
+	// Serving again while the earlier request is still in flight starts
+	// with a limit of its own.
+	later := srv.trackRequests(http.NotFoundHandler(), nil, nil, managed)
+	rec := httptest.NewRecorder()
+	later.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected the request to be served, got %d", rec.Code)
+	}
+
+	close(release)
+	select {
+	case <-served:
+	case <-time.After(waitTime):
+		t.Fatal("expected the earlier request to release its token and return")
+	}
+}
@@ -0,0 +1,85 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// listenerEnv is the environment variable through which RestartWithExec
+// tells the new process the file descriptor of the inherited listener.
+const listenerEnv = "GRACEFUL_LISTENER_FD"
+
+// ErrRestartUnsupported is returned by RestartWithExec on platforms that
+// can't pass listeners on to new processes.
+var ErrRestartUnsupported = errors.New("restart is not supported on " + runtime.GOOS)
+
+// ErrNoRestartListener is returned by RestartWithExec when the server has
+// no TCP or Unix listener to pass on.
+var ErrNoRestartListener = errors.New("no TCP or Unix listener to pass on")
+
+// filer is implemented by the listeners whose file descriptor can be
+// passed on, such as *net.TCPListener and *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// inherited holds the listener handed to this process by RestartWithExec
+// until it is picked up.
+var inherited struct {
+	sync.Mutex
+	l net.Listener
+}
+
+// InheritListener returns the listener handed to this process by
+// RestartWithExec, if any. It can be picked up only once.
+func InheritListener() (net.Listener, bool) {
+	return takeInherited(func(net.Addr) bool { return true })
+}
+
+// inheritListener returns the inherited listener if it listens on addr,
+// so that with several Servers in the process only the one it was handed
+// over for picks it up.
+func inheritListener(addr string) (net.Listener, bool) {
+	return takeInherited(func(a net.Addr) bool { return sameAddr(a, addr) })
+}
+
+// takeInherited returns the inherited listener if match accepts its
+// address.
+func takeInherited(match func(net.Addr) bool) (net.Listener, bool) {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	// The descriptor is taken out of the environment once loaded.
+	if inherited.l == nil {
+		inherited.l, _ = loadInherited()
+	}
+	l := inherited.l
+	if l == nil || !match(l.Addr()) {
+		return nil, false
+	}
+	inherited.l = nil
+	return l, true
+}
+
+// sameAddr reports whether a is the address listening on addr would have.
+// A zero port in addr never matches, as it could be any port.
+func sameAddr(a net.Addr, addr string) bool {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return false
+	}
+	got, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if want.Port == 0 || want.Port != got.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP.IsUnspecified()
+	}
+	return want.IP.Equal(got.IP)
+}
@@ -0,0 +1,17 @@
+//+build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package graceful
+
+import "net"
+
+// RestartWithExec returns ErrRestartUnsupported, as listeners can't be
+// passed on to new processes on this platform.
+func (srv *Server) RestartWithExec() error {
+	return ErrRestartUnsupported
+}
+
+// loadInherited returns false, as listeners can't be inherited on this
+// platform.
+func loadInherited() (net.Listener, bool) {
+	return nil, false
+}
@@ -0,0 +1,111 @@
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestInheritListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graceful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		network, addr string
+	}{
+		{"tcp", "127.0.0.1:0"},
+		{"unix", filepath.Join(dir, "sock")},
+	}
+	for _, test := range tests {
+		l, err := net.Listen(test.network, test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(filer).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		// InheritListener takes ownership of the descriptor it is handed,
+		// so give it a copy rather than the one f closes.
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		os.Setenv(listenerEnv, strconv.Itoa(fd))
+		inherited, ok := InheritListener()
+		if !ok {
+			t.Fatalf("expected to inherit the %s listener", test.network)
+		}
+		defer inherited.Close()
+		if inherited.Addr().String() != l.Addr().String() {
+			t.Errorf("expected address %s, got %s", l.Addr(), inherited.Addr())
+		}
+		if _, ok := InheritListener(); ok {
+			t.Error("expected the listener to be inherited only once")
+		}
+	}
+}
+
+func TestInheritListenerMatchesAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(filer).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(listenerEnv, strconv.Itoa(fd))
+	defer func() {
+		// Don't leave the listener behind for other tests.
+		if l, ok := InheritListener(); ok {
+			l.Close()
+		}
+	}()
+
+	// The first server listens elsewhere and must not take the socket.
+	other, err := (&Server{}).newTCPListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if other.Addr().String() == l.Addr().String() {
+		t.Fatal("expected the server on another address to bind its own listener")
+	}
+
+	// The second one listens on the inherited address, which is still
+	// bound by l, so it can only be served through the inherited socket.
+	own, err := (&Server{}).newTCPListener(l.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the server on the inherited address to take it over: %v", err)
+	}
+	defer own.Close()
+	if own.Addr().String() != l.Addr().String() {
+		t.Errorf("expected address %s, got %s", l.Addr(), own.Addr())
+	}
+}
+
+func TestRestartWithExecWithoutListener(t *testing.T) {
+	srv := &Server{}
+	if err := srv.RestartWithExec(); err != ErrNoRestartListener {
+		t.Errorf("expected ErrNoRestartListener, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// RestartWithExec starts the current executable again, with the same
+// arguments, handing it the server's listener, and then shuts the server
+// down gracefully as if Stop(Timeout) had been called. The new process
+// picks the listener up with InheritListener, which ListenAndServe does by
+// itself, so that no connections are refused while it starts.
+func (srv *Server) RestartWithExec() error {
+	srv.chanLock.RLock()
+	l := srv.restartListener
+	srv.chanLock.RUnlock()
+	fl, ok := l.(filer)
+	if !ok {
+		return ErrNoRestartListener
+	}
+	// Leave the socket file for the new process.
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	f, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ExtraFiles start at file descriptor 3.
+	cmd.ExtraFiles = []*os.File{f}
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, listenerEnv+"=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, listenerEnv+"=3")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	srv.logw(LevelInfo, map[string]interface{}{"pid": cmd.Process.Pid}, "restarted as process %d", cmd.Process.Pid)
+
+	srv.interruptChan() <- stopSignal{}
+	return nil
+}
+
+// loadInherited turns the descriptor handed to this process by
+// RestartWithExec, if any, into a listener.
+func loadInherited() (net.Listener, bool) {
+	fd, err := strconv.Atoi(os.Getenv(listenerEnv))
+	if err != nil {
+		return nil, false
+	}
+	os.Unsetenv(listenerEnv)
+
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, false
+	}
+	return l, true
+}
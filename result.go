@@ -0,0 +1,88 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+)
+
+// Cause is the reason Serve returned.
+type Cause int
+
+const (
+	// CauseDrained is the cause when shutdown completed with all
+	// connections finishing in time.
+	CauseDrained Cause = iota
+
+	// CauseKilled is the cause when connections were killed because
+	// Timeout expired.
+	CauseKilled
+
+	// CauseCancelled is the cause when one of Cancels, TimedCancel,
+	// ShutdownFile or MemoryLimit triggered a shutdown that drained all
+	// connections in time.
+	CauseCancelled
+
+	// CauseListenerError is the cause when accepting connections failed.
+	CauseListenerError
+
+	// CauseStartError is the cause when the server could not start
+	// serving, e.g. because the address could not be bound.
+	CauseStartError
+)
+
+var causeNames = map[Cause]string{
+	CauseDrained:       "drained",
+	CauseKilled:        "killed",
+	CauseCancelled:     "cancelled",
+	CauseListenerError: "listener error",
+	CauseStartError:    "start error",
+}
+
+func (c Cause) String() string {
+	if name, ok := causeNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Result describes why Serve returned.
+type Result struct {
+	Cause Cause
+
+	// Trigger names what initiated the shutdown, as in TriggerTimeouts.
+	// It is empty if no shutdown was initiated.
+	Trigger string
+
+	// Killed is the number of connections killed because Timeout expired.
+	Killed int
+}
+
+// ServeWithResult is like Serve, but also reports why it returned. It
+// waits for the drain to complete even if BackgroundDrain is set.
+func (srv *Server) ServeWithResult(l net.Listener) (Result, error) {
+	ready := make(chan struct{})
+	err := srv.serve(l, ready, nil)
+	select {
+	case <-ready:
+	default:
+		return Result{Cause: CauseStartError}, err
+	}
+	<-srv.StopChan()
+
+	srv.chanLock.RLock()
+	res := Result{Trigger: srv.trigger, Killed: srv.shutdownResult.killed}
+	timedOut := srv.shutdownResult.timedOut
+	srv.chanLock.RUnlock()
+
+	switch {
+	case err != nil && err != ErrConnectionsLingering && err != http.ErrServerClosed:
+		res.Cause = CauseListenerError
+	case timedOut:
+		res.Cause = CauseKilled
+	case res.Trigger == TriggerCancel:
+		res.Cause = CauseCancelled
+	default:
+		res.Cause = CauseDrained
+	}
+	return res, err
+}
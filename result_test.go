@@ -0,0 +1,72 @@
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeWithResult(t *testing.T) {
+	serve := func(srv *Server, l net.Listener) chan Result {
+		results := make(chan Result, 1)
+		go func() {
+			res, _ := srv.ServeWithResult(l)
+			results <- res
+		}()
+		time.Sleep(waitTime)
+		return results
+	}
+	expect := func(results chan Result, cause Cause, killed int) {
+		t.Helper()
+		select {
+		case res := <-results:
+			if res.Cause != cause || res.Killed != killed {
+				t.Errorf("expected %s with %d killed, got %s with %d killed", cause, killed, res.Cause, res.Killed)
+			}
+		case <-time.After(timeoutTime):
+			t.Fatalf("expected ServeWithResult to return with %s", cause)
+		}
+	}
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	res, err := (&Server{Server: &http.Server{}, NoSignalHandling: true}).ServeWithResult(listen())
+	if err != ErrNoHandler || res.Cause != CauseStartError {
+		t.Errorf("expected a start error, got %s, %v", res.Cause, err)
+	}
+
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	results := serve(srv, listen())
+	srv.Stop(0)
+	expect(results, CauseDrained, 0)
+
+	cancel := make(chan struct{})
+	srv = &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, Cancels: []<-chan struct{}{cancel}, NoSignalHandling: true}
+	results = serve(srv, listen())
+	close(cancel)
+	expect(results, CauseCancelled, 0)
+
+	l := listen()
+	srv = &Server{Server: &http.Server{Handler: http.NotFoundHandler()}, NoSignalHandling: true}
+	results = serve(srv, l)
+	l.Close()
+	expect(results, CauseListenerError, 0)
+
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = &Server{Server: server, NoSignalHandling: true}
+	results = serve(srv, l)
+	go http.Get(fmt.Sprintf("http://localhost:%d", port))
+	time.Sleep(waitTime)
+	srv.Stop(waitTime)
+	expect(results, CauseKilled, 1)
+}
@@ -0,0 +1,9 @@
+//+build appengine !windows
+
+package graceful
+
+// RunService calls serve, as there is no service control manager to run
+// the process as a service of on this platform.
+func (srv *Server) RunService(name string, serve func() error) error {
+	return serve()
+}
@@ -0,0 +1,25 @@
+//+build !windows
+
+package graceful
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRunServiceServes(t *testing.T) {
+	srv := &Server{Server: &http.Server{}}
+	failed := errors.New("serve failed")
+	served := false
+	err := srv.RunService("graceful", func() error {
+		served = true
+		return failed
+	})
+	if !served {
+		t.Error("expected RunService to serve outside of a service control manager")
+	}
+	if err != failed {
+		t.Errorf("expected the error serving, got %v", err)
+	}
+}
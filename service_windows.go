@@ -0,0 +1,198 @@
+//+build !appengine,windows
+
+package graceful
+
+import (
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 0x1
+	serviceAcceptShutdown = 0x4
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+	errorServiceSpecificError           = 1066
+)
+
+// serviceStatus is the SERVICE_STATUS reported to the service control
+// manager.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is a SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// service is the service run by RunService. The service control manager
+// calls back into the process without any way to pass Go values, and a
+// process runs a single service, so it is kept here.
+var service struct {
+	sync.Mutex
+	name   *uint16
+	srv    *Server
+	serve  func() error
+	handle uintptr
+	status serviceStatus
+	err    error
+}
+
+var (
+	serviceMainCallback    = syscall.NewCallback(serviceMain)
+	serviceHandlerCallback = syscall.NewCallback(serviceHandler)
+)
+
+// serviceStopSignal is sent on the interrupt channel when the service
+// control manager asks the service to stop.
+type serviceStopSignal struct{}
+
+func (serviceStopSignal) String() string { return TriggerServiceStop }
+func (serviceStopSignal) Signal()        {}
+
+// RunService runs the process as the Windows service name, calling serve,
+// e.g. srv.ListenAndServe, to serve while the service is running. A stop
+// request from the service control manager, or the system shutting down,
+// shuts srv down like a signal, with the trigger TriggerServiceStop, and
+// the service reports it is stopping until serve returns. The service then
+// reports it has stopped, failing if serve returned an error, which
+// RunService returns. If the process was not started by the service
+// control manager, e.g. when run from a console, serve is called directly.
+func (srv *Server) RunService(name string, serve func() error) error {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	service.Lock()
+	service.name, service.srv, service.serve, service.err = n, srv, serve, nil
+	service.Unlock()
+
+	// StartServiceCtrlDispatcherW returns once the service has stopped.
+	table := []serviceTableEntry{{n, serviceMainCallback}, {nil, 0}}
+	r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		if err == syscall.Errno(errorFailedServiceControllerConnect) {
+			return serve()
+		}
+		return err
+	}
+
+	service.Lock()
+	defer service.Unlock()
+	return service.err
+}
+
+// serviceMain is the ServiceMain of the service, run by the service
+// control manager once it has started the service.
+func serviceMain(argc, argv uintptr) uintptr {
+	service.Lock()
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(service.name)), serviceHandlerCallback, 0)
+	if h == 0 {
+		service.err = err
+		service.Unlock()
+		return 0
+	}
+	service.handle = h
+	setServiceStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown, 0, 0)
+	serve := service.serve
+	service.Unlock()
+
+	err = serve()
+
+	service.Lock()
+	defer service.Unlock()
+	service.err = err
+	var exitCode uint32
+	if err != nil {
+		exitCode = errorServiceSpecificError
+	}
+	setServiceStatus(serviceStopped, 0, exitCode, 0)
+	return 0
+}
+
+// serviceHandler is the HandlerEx of the service, called by the service
+// control manager with its requests.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	service.Lock()
+	defer service.Unlock()
+
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		if service.status.currentState != serviceRunning {
+			return 0
+		}
+		srv := service.srv
+		setServiceStatus(serviceStopPending, 0, 0, srv.serviceWaitHint())
+		// A shutdown already pending covers this request.
+		select {
+		case srv.interruptChan() <- serviceStopSignal{}:
+		default:
+		}
+		return 0
+	case serviceControlInterrogate:
+		s := service.status
+		procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&s)))
+		return 0
+	}
+	return errorCallNotImplemented
+}
+
+// setServiceStatus reports the service's state to the service control
+// manager. The service must be locked.
+func setServiceStatus(state, accepted, exitCode uint32, waitHint time.Duration) {
+	service.status = serviceStatus{
+		serviceType:      serviceWin32OwnProcess,
+		currentState:     state,
+		controlsAccepted: accepted,
+		win32ExitCode:    exitCode,
+		waitHint:         uint32(waitHint / time.Millisecond),
+	}
+	if exitCode == errorServiceSpecificError {
+		service.status.serviceSpecificExitCode = 1
+	}
+	s := service.status
+	if r, _, err := procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&s))); r == 0 {
+		service.srv.logw(LevelError, map[string]interface{}{"error": err}, "reporting service status: %s", err)
+	}
+}
+
+// serviceWaitHint is how long stopping the service is expected to take,
+// or zero if the drain has no deadline.
+func (srv *Server) serviceWaitHint() time.Duration {
+	timeout := srv.triggerTimeout(TriggerServiceStop, false, 0)
+	if timeout == 0 {
+		return 0
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return srv.ListenerCloseDelay + srv.DrainAcceptGrace + timeout
+}
@@ -1,4 +1,4 @@
-//+build !appengine
+//+build !appengine,!windows
 
 package graceful
 
@@ -12,6 +12,6 @@ func signalNotify(interrupt chan<- os.Signal) {
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
 }
 
-func sendSignalInt(interrupt chan<- os.Signal) {
-	interrupt <- syscall.SIGINT
+func signalStop(c chan<- os.Signal) {
+	signal.Stop(c)
 }
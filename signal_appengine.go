@@ -8,6 +8,4 @@ func signalNotify(interrupt chan<- os.Signal) {
 	// Does not notify in the case of AppEngine.
 }
 
-func sendSignalInt(interrupt chan<- os.Signal) {
-	// Does not send in the case of AppEngine.
-}
+func signalStop(c chan<- os.Signal) {}
@@ -0,0 +1,10 @@
+//+build appengine !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package graceful
+
+import "os"
+
+func signalNotifyReload(reload chan<- os.Signal) {
+	// There is no SIGHUP outside of Unix, e.g. on Windows; use
+	// ReloadHandler instead.
+}
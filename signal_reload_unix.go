@@ -0,0 +1,14 @@
+//+build !appengine
+//+build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package graceful
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func signalNotifyReload(reload chan<- os.Signal) {
+	signal.Notify(reload, syscall.SIGHUP)
+}
@@ -0,0 +1,21 @@
+//+build !appengine,windows
+
+package graceful
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// On Windows os.Interrupt is delivered for Ctrl+C and Ctrl+Break, and
+// syscall.SIGTERM when the console is closed or the user logs off or shuts
+// down. A service's stop request comes from the service control manager
+// instead, which RunService passes on.
+func signalNotify(interrupt chan<- os.Signal) {
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+}
+
+func signalStop(c chan<- os.Signal) {
+	signal.Stop(c)
+}
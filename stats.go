@@ -0,0 +1,344 @@
+package graceful
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// State is the lifecycle state of a Server.
+type State int
+
+const (
+	// StateIdle is the state of a Server that has not started serving.
+	StateIdle State = iota
+
+	// StateServing is the state of a Server accepting connections.
+	StateServing
+
+	// StateDraining is the state of a Server that has stopped accepting
+	// connections and is waiting for the remaining ones to finish.
+	StateDraining
+
+	// StateStopped is the state of a Server that has completed shutdown.
+	StateStopped
+)
+
+var stateNames = map[State]string{
+	StateIdle:     "idle",
+	StateServing:  "serving",
+	StateDraining: "draining",
+	StateStopped:  "stopped",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// stats is the bookkeeping reported by Snapshot. It is updated by the
+// connection manager and the shutdown process.
+type stats struct {
+	sync.Mutex
+	state         State
+	live          int
+	peak          int
+	total         uint64
+	killed        uint64
+	completed     uint64
+	drainRejected uint64
+	shutdownStart time.Time
+	drainDeadline time.Time
+	lastShutdown  time.Duration
+
+	// listening is whether the listener is open, which it stays during
+	// ListenerCloseDelay and DrainAcceptGrace.
+	listening bool
+
+	// lastAccept is when the last connection was accepted, and
+	// acceptInterval the moving average of the intervals between them.
+	lastAccept     time.Time
+	acceptInterval time.Duration
+
+	// newConns, activeConns and idleConns break live down by state.
+	newConns    int
+	activeConns int
+	idleConns   int
+}
+
+func (s *stats) setListening(listening bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.listening = listening
+}
+
+func (s *stats) setState(state State) {
+	s.Lock()
+	defer s.Unlock()
+
+	if state == StateDraining {
+		if s.state == StateDraining {
+			return
+		}
+		s.shutdownStart = time.Now()
+		s.drainDeadline = time.Time{}
+	}
+	if state == StateStopped && !s.shutdownStart.IsZero() {
+		s.lastShutdown = time.Since(s.shutdownStart)
+	}
+	s.state = state
+}
+
+// current returns the lifecycle state.
+func (s *stats) current() State {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.state
+}
+
+// setDrainDeadline records when the remaining connections will be killed,
+// or the zero time if the drain waits for them indefinitely.
+func (s *stats) setDrainDeadline(deadline time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.drainDeadline = deadline
+}
+
+// deadline returns the drain deadline, if the server is draining and has
+// one.
+func (s *stats) deadline() (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.state != StateDraining || s.drainDeadline.IsZero() {
+		return time.Time{}, false
+	}
+	return s.drainDeadline, true
+}
+
+func (s *stats) added(live int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.total++
+	s.live = live
+	if live > s.peak {
+		s.peak = live
+	}
+}
+
+// accepted records that a connection was accepted at now.
+func (s *stats) accepted(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.lastAccept.IsZero() {
+		interval := now.Sub(s.lastAccept)
+		if s.acceptInterval == 0 {
+			s.acceptInterval = interval
+		} else {
+			s.acceptInterval += (interval - s.acceptInterval) / acceptIntervalWeight
+		}
+	}
+	s.lastAccept = now
+}
+
+func (s *stats) removed(live int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.live = live
+}
+
+// connStates records how many of the tracked connections are new, active
+// and idle.
+func (s *stats) connStates(newConns, activeConns, idleConns int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.newConns = newConns
+	s.activeConns = activeConns
+	s.idleConns = idleConns
+}
+
+func (s *stats) kill(n, live int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.killed += uint64(n)
+	s.live = live
+}
+
+// requestDone counts a completed request.
+func (s *stats) requestDone() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.completed++
+}
+
+func (s *stats) completedCount() uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.completed
+}
+
+// rejected counts a connection or request refused because the server is
+// draining.
+func (s *stats) rejected() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.drainRejected++
+}
+
+// Snapshot is a consistent view of a Server's lifecycle at one point in
+// time.
+type Snapshot struct {
+	State State
+
+	// Accepting reports whether the listener is open, as it still is during
+	// ListenerCloseDelay, and accepting isn't paused.
+	Accepting bool
+
+	Connections       int
+	PeakConnections   int
+	TotalConnections  uint64
+	KilledConnections uint64
+
+	// ShutdownStarted is the time shutdown began, or the zero time if the
+	// server hasn't started shutting down.
+	ShutdownStarted time.Time
+
+	// SinceShutdown is the time elapsed since ShutdownStarted.
+	SinceShutdown time.Duration
+
+	// AcceptInterval is the moving average of the time between accepted
+	// connections, or zero until two have been accepted. A sharp drop
+	// points at a connection flood, which may fill the listen backlog.
+	AcceptInterval time.Duration
+}
+
+// Draining reports whether the server is waiting for connections to finish
+// before stopping.
+func (s Snapshot) Draining() bool {
+	return s.State == StateDraining
+}
+
+// MarshalJSON encodes the snapshot for status endpoints, with durations in
+// seconds.
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	v := struct {
+		State             string     `json:"state"`
+		Accepting         bool       `json:"accepting"`
+		Draining          bool       `json:"draining"`
+		Connections       int        `json:"connections"`
+		PeakConnections   int        `json:"peak_connections"`
+		TotalConnections  uint64     `json:"total_connections"`
+		KilledConnections uint64     `json:"killed_connections"`
+		ShutdownStarted   *time.Time `json:"shutdown_started,omitempty"`
+		SinceShutdown     float64    `json:"since_shutdown,omitempty"`
+		AcceptInterval    float64    `json:"accept_interval,omitempty"`
+	}{
+		State:             s.State.String(),
+		Accepting:         s.Accepting,
+		Draining:          s.Draining(),
+		Connections:       s.Connections,
+		PeakConnections:   s.PeakConnections,
+		TotalConnections:  s.TotalConnections,
+		KilledConnections: s.KilledConnections,
+		SinceShutdown:     s.SinceShutdown.Seconds(),
+		AcceptInterval:    s.AcceptInterval.Seconds(),
+	}
+	if !s.ShutdownStarted.IsZero() {
+		v.ShutdownStarted = &s.ShutdownStarted
+	}
+	return json.Marshal(v)
+}
+
+// Snapshot returns the current lifecycle state and connection counters of
+// the server.
+func (srv *Server) Snapshot() Snapshot {
+	srv.stats.Lock()
+	defer srv.stats.Unlock()
+
+	snap := Snapshot{
+		State:             srv.stats.state,
+		Accepting:         srv.stats.listening && srv.resumed() == nil,
+		Connections:       srv.stats.live,
+		PeakConnections:   srv.stats.peak,
+		TotalConnections:  srv.stats.total,
+		KilledConnections: srv.stats.killed,
+		ShutdownStarted:   srv.stats.shutdownStart,
+		AcceptInterval:    srv.stats.acceptInterval,
+	}
+	if !snap.ShutdownStarted.IsZero() {
+		snap.SinceShutdown = time.Since(snap.ShutdownStarted)
+	}
+	return snap
+}
+
+// ResetStats starts a fresh window for the cumulative counters reported by
+// Snapshot, e.g. after an incident: TotalConnections and KilledConnections
+// are zeroed and PeakConnections is set to the current number of
+// connections. DrainRejectedCount is zeroed as well. The current state and
+// connections are unaffected.
+func (srv *Server) ResetStats() {
+	srv.stats.Lock()
+	defer srv.stats.Unlock()
+
+	srv.stats.total = 0
+	srv.stats.killed = 0
+	srv.stats.drainRejected = 0
+	srv.stats.peak = srv.stats.live
+}
+
+// DrainRejectedCount returns how many connections and requests have been
+// turned away because the server was draining: connections refused by the
+// DrainAllowlist and upgrades refused by RejectUpgradesOnShutdown. Compare
+// it across shutdowns to gauge their impact on clients and tune
+// DrainAcceptGrace and load balancer deregistration.
+func (srv *Server) DrainRejectedCount() uint64 {
+	srv.stats.Lock()
+	defer srv.stats.Unlock()
+
+	return srv.stats.drainRejected
+}
+
+// RemainingDrainTime returns how long the server will keep waiting for
+// connections to finish before killing them. Hooks and handlers may use it
+// to decide whether to start more work or wrap up. If no kill is scheduled,
+// because the server isn't draining or Timeout is zero, it returns the
+// maximum time.Duration.
+func (srv *Server) RemainingDrainTime() time.Duration {
+	deadline, ok := srv.stats.deadline()
+	if !ok {
+		return math.MaxInt64
+	}
+	if d := time.Until(deadline); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// ConnectionCountByState returns how many connections are currently in
+// each of the states http.StateNew, http.StateActive and http.StateIdle.
+// Hijacked and closed connections are no longer tracked.
+func (srv *Server) ConnectionCountByState() map[http.ConnState]int {
+	srv.stats.Lock()
+	defer srv.stats.Unlock()
+
+	return map[http.ConnState]int{
+		http.StateNew:    srv.stats.newConns,
+		http.StateActive: srv.stats.activeConns,
+		http.StateIdle:   srv.stats.idleConns,
+	}
+}
@@ -0,0 +1,193 @@
+package graceful
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	if snap := srv.Snapshot(); snap.State != StateIdle || snap.Accepting {
+		t.Errorf("unexpected snapshot before serving: %+v", snap)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client := &http.Client{Transport: &http.Transport{}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	snap := srv.Snapshot()
+	if snap.State != StateServing || !snap.Accepting || snap.Connections != 1 || snap.TotalConnections != 1 {
+		t.Errorf("unexpected snapshot while serving: %+v", snap)
+	}
+
+	srv.Stop(0)
+	time.Sleep(waitTime)
+	snap = srv.Snapshot()
+	if !snap.Draining() || snap.Accepting || snap.ShutdownStarted.IsZero() || snap.SinceShutdown <= 0 {
+		t.Errorf("unexpected snapshot while draining: %+v", snap)
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"state":"draining"`) || !strings.Contains(string(b), `"peak_connections":1`) {
+		t.Errorf("unexpected JSON %s", b)
+	}
+
+	<-srv.StopChan()
+	<-done
+	if snap := srv.Snapshot(); snap.State != StateStopped || snap.Connections != 0 || snap.PeakConnections != 1 {
+		t.Errorf("unexpected snapshot after stopping: %+v", snap)
+	}
+}
+
+func TestRemainingDrainTime(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	if d := srv.RemainingDrainTime(); d != math.MaxInt64 {
+		t.Errorf("expected no kill to be scheduled before serving, got %s", d)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client := &http.Client{Transport: &http.Transport{}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	time.Sleep(waitTime)
+	if d := srv.RemainingDrainTime(); d <= 0 || d > killTime-waitTime {
+		t.Errorf("expected less than %s left to drain, got %s", killTime-waitTime, d)
+	}
+
+	<-srv.StopChan()
+	<-done
+	if d := srv.RemainingDrainTime(); d != math.MaxInt64 {
+		t.Errorf("expected no kill to be scheduled after stopping, got %s", d)
+	}
+}
+
+func TestConnectionCountByState(t *testing.T) {
+	server, l, err := createListener(killTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client := &http.Client{Transport: &http.Transport{}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(waitTime)
+
+	counts := srv.ConnectionCountByState()
+	if counts[http.StateActive] != 1 || counts[http.StateIdle] != 0 || counts[http.StateNew] != 0 {
+		t.Errorf("unexpected counts while serving: %v", counts)
+	}
+
+	<-done
+	time.Sleep(waitTime)
+	counts = srv.ConnectionCountByState()
+	if counts[http.StateActive] != 0 || counts[http.StateIdle] != 1 {
+		t.Errorf("unexpected counts with an idle connection: %v", counts)
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+	counts = srv.ConnectionCountByState()
+	if counts[http.StateActive] != 0 || counts[http.StateIdle] != 0 || counts[http.StateNew] != 0 {
+		t.Errorf("unexpected counts after stopping: %v", counts)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	srv := &Server{}
+	srv.stats.setState(StateServing)
+	for live := 1; live <= 3; live++ {
+		srv.stats.added(live)
+	}
+	srv.stats.kill(1, 2)
+
+	srv.ResetStats()
+	snap := srv.Snapshot()
+	if snap.TotalConnections != 0 || snap.KilledConnections != 0 || snap.PeakConnections != 2 {
+		t.Errorf("unexpected counters after reset: %+v", snap)
+	}
+	if snap.Connections != 2 || snap.State != StateServing {
+		t.Errorf("expected the live state to be kept: %+v", snap)
+	}
+}
+
+func TestInFlightRequestDrainDeadline(t *testing.T) {
+	started := make(chan struct{})
+	deadlines := make(chan time.Time, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(2 * waitTime)
+		deadline, _ := r.Context().Deadline()
+		deadlines <- deadline
+	})
+	server, l, err := createListener(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handler = mux
+
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	go func() {
+		client := &http.Client{Transport: &http.Transport{}}
+		if resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	// The request began before the drain, and learns of its deadline.
+	start := time.Now()
+	srv.Stop(killTime)
+	deadline := <-deadlines
+	if d := deadline.Sub(start); d < killTime-waitTime || d > killTime+waitTime {
+		t.Errorf("expected the request deadline about %s after shutdown began, got %s", killTime, d)
+	}
+	<-srv.StopChan()
+}
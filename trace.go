@@ -0,0 +1,63 @@
+package graceful
+
+import "context"
+
+// Tracer lets the phases of shutdown be recorded as spans in a tracing
+// system, such as OpenTelemetry, through a small adapter.
+//
+// The whole shutdown is a span named "graceful.shutdown". Its children are
+// "graceful.before_shutdown" and "graceful.shutdown_initiated" for the
+// hooks, "graceful.drain" for waiting on connections and "graceful.kill"
+// for killing the ones left when Timeout expires.
+type Tracer interface {
+	// StartSpan starts a span with the given name as a child of the span
+	// in ctx, if any, and returns a context holding the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// End completes the span.
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span with the Tracer, if one is set.
+func (srv *Server) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if srv.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return srv.Tracer.StartSpan(ctx, name)
+}
+
+// shutdownTrace holds the span of the shutdown in progress.
+type shutdownTrace struct {
+	ctx  context.Context
+	span Span
+}
+
+// setShutdownTrace records the span of the shutdown that has begun.
+func (srv *Server) setShutdownTrace(ctx context.Context, span Span) {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	srv.trace = &shutdownTrace{ctx, span}
+}
+
+// takeShutdownTrace returns the span of the shutdown in progress, starting
+// one if shutdown didn't begin with a trigger, e.g. because the listener
+// failed.
+func (srv *Server) takeShutdownTrace() (context.Context, Span) {
+	srv.chanLock.Lock()
+	trace := srv.trace
+	srv.trace = nil
+	srv.chanLock.Unlock()
+
+	if trace == nil {
+		return srv.startSpan(context.Background(), "graceful.shutdown")
+	}
+	return trace.ctx, trace.span
+}
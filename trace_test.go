@@ -0,0 +1,78 @@
+package graceful
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTracer records the names of spans in the order they end, along
+// with their parents.
+type recordingTracer struct {
+	sync.Mutex
+	ended   []string
+	parents map[string]string
+}
+
+type spanKey struct{}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	t.Lock()
+	defer t.Unlock()
+	if parent, ok := ctx.Value(spanKey{}).(string); ok {
+		t.parents[name] = parent
+	}
+	return context.WithValue(ctx, spanKey{}, name), &recordingSpan{t, name}
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s.name)
+}
+
+func TestTracer(t *testing.T) {
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer := &recordingTracer{parents: map[string]string{}}
+	srv := &Server{
+		Server:           server,
+		Timeout:          waitTime,
+		BeforeShutdown:   func() bool { return true },
+		Tracer:           tracer,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	srv.Stop(waitTime)
+	<-srv.StopChan()
+	wg.Wait()
+
+	tracer.Lock()
+	defer tracer.Unlock()
+	expected := []string{"graceful.before_shutdown", "graceful.kill", "graceful.drain", "graceful.shutdown"}
+	if !reflect.DeepEqual(tracer.ended, expected) {
+		t.Errorf("expected spans %v, got %v", expected, tracer.ended)
+	}
+	for _, name := range expected[:3] {
+		if tracer.parents[name] != "graceful.shutdown" {
+			t.Errorf("expected %s to be a child of the shutdown span, got %q", name, tracer.parents[name])
+		}
+	}
+}
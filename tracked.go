@@ -0,0 +1,42 @@
+package graceful
+
+import "net"
+
+// trackQuery asks the connection manager whether conn is tracked.
+type trackQuery struct {
+	conn  net.Conn
+	reply chan bool
+}
+
+// IsTracked reports whether conn is among the connections the server is
+// tracking, e.g. to check from a handler, with the connection obtained via
+// ConnFromContext, that it will be waited on during shutdown. It reports
+// false once the goroutine tracking connections has exited.
+func (srv *Server) IsTracked(conn net.Conn) bool {
+	srv.chanLock.RLock()
+	managed := srv.managed
+	srv.chanLock.RUnlock()
+	if managed == nil {
+		return false
+	}
+
+	q := trackQuery{conn: conn, reply: make(chan bool, 1)}
+	select {
+	case srv.trackChan() <- q:
+		return <-q.reply
+	case <-managed:
+		return false
+	}
+}
+
+// trackChan returns the channel the connection manager answers
+// IsTracked on.
+func (srv *Server) trackChan() chan trackQuery {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.tracked == nil {
+		srv.tracked = make(chan trackQuery)
+	}
+	return srv.tracked
+}
@@ -0,0 +1,34 @@
+package graceful
+
+import (
+	"os"
+	"syscall"
+)
+
+// Names of shutdown triggers, as used by TriggerTimeouts.
+const (
+	TriggerSIGINT  = "SIGINT"
+	TriggerSIGTERM = "SIGTERM"
+	TriggerStop    = "stop"
+	TriggerCancel  = "cancel"
+
+	// TriggerStopAndWait names shutdowns initiated by StopAndWait. Their
+	// drain is only limited by the context, so TriggerTimeouts doesn't
+	// apply to them.
+	TriggerStopAndWait = "stop-and-wait"
+
+	// TriggerServiceStop names shutdowns requested by the Windows service
+	// control manager of a service run by RunService.
+	TriggerServiceStop = "service-stop"
+)
+
+// triggerName names the trigger of a shutdown initiated by sig.
+func triggerName(sig os.Signal) string {
+	switch sig {
+	case os.Interrupt:
+		return TriggerSIGINT
+	case syscall.SIGTERM:
+		return TriggerSIGTERM
+	}
+	return sig.String()
+}
@@ -0,0 +1,110 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Validate checks the Server's configuration for invalid values and
+// conflicting settings. It may be called before ListenAndServe or Serve to
+// surface misconfiguration early; it does not start the server.
+func (srv *Server) Validate() error {
+	if srv.Server == nil {
+		return errors.New("no http.Server configured")
+	}
+	if err := srv.checkHandler(); err != nil {
+		return err
+	}
+	if srv.Timeout < 0 {
+		return fmt.Errorf("negative Timeout %s", srv.Timeout)
+	}
+	if srv.ListenLimit < 0 {
+		return fmt.Errorf("negative ListenLimit %d", srv.ListenLimit)
+	}
+	if srv.ListenBacklog < 0 {
+		return fmt.Errorf("negative ListenBacklog %d", srv.ListenBacklog)
+	}
+	if srv.RebindOnFailure < 0 {
+		return fmt.Errorf("negative RebindOnFailure %d", srv.RebindOnFailure)
+	}
+	if srv.TCPKeepAlive < 0 {
+		return fmt.Errorf("negative TCPKeepAlive %s", srv.TCPKeepAlive)
+	}
+	if srv.MaxInFlight < 0 {
+		return fmt.Errorf("negative MaxInFlight %d", srv.MaxInFlight)
+	}
+	if srv.MaxQueue < 0 {
+		return fmt.Errorf("negative MaxQueue %d", srv.MaxQueue)
+	}
+	if srv.ListenerCloseDelay < 0 {
+		return fmt.Errorf("negative ListenerCloseDelay %s", srv.ListenerCloseDelay)
+	}
+	if srv.DrainAcceptGrace < 0 {
+		return fmt.Errorf("negative DrainAcceptGrace %s", srv.DrainAcceptGrace)
+	}
+	if srv.AcceptIdleWarn < 0 {
+		return fmt.Errorf("negative AcceptIdleWarn %s", srv.AcceptIdleWarn)
+	}
+	if srv.PollDrain < 0 {
+		return fmt.Errorf("negative PollDrain %s", srv.PollDrain)
+	}
+	if srv.MaxConnLifetime < 0 {
+		return fmt.Errorf("negative MaxConnLifetime %s", srv.MaxConnLifetime)
+	}
+	if srv.MaxConnsPerIP < 0 {
+		return fmt.Errorf("negative MaxConnsPerIP %d", srv.MaxConnsPerIP)
+	}
+	if srv.KillRate < 0 {
+		return fmt.Errorf("negative KillRate %d", srv.KillRate)
+	}
+	if srv.MaxConcurrentCloses < 0 {
+		return fmt.Errorf("negative MaxConcurrentCloses %d", srv.MaxConcurrentCloses)
+	}
+	if srv.KillOrder < KillRandom || srv.KillOrder > KillIdleFirst {
+		return fmt.Errorf("unknown KillOrder %d", srv.KillOrder)
+	}
+	if srv.PostKillGrace < 0 {
+		return fmt.Errorf("negative PostKillGrace %s", srv.PostKillGrace)
+	}
+	if srv.MemoryLimitDuration < 0 {
+		return fmt.Errorf("negative MemoryLimitDuration %s", srv.MemoryLimitDuration)
+	}
+	if srv.MinDrainTime < 0 {
+		return fmt.Errorf("negative MinDrainTime %s", srv.MinDrainTime)
+	}
+	for _, d := range srv.EscalationTimeouts {
+		if d < 0 {
+			return fmt.Errorf("negative EscalationTimeouts entry %s", d)
+		}
+	}
+	if srv.NoSignalHandling && len(srv.SignalModes) > 0 {
+		return errors.New("SignalModes has no effect with NoSignalHandling")
+	}
+	for sig, mode := range srv.SignalModes {
+		if mode != Graceful && mode != Immediate {
+			return fmt.Errorf("invalid ShutdownMode %d for %s", mode, sig)
+		}
+	}
+	return nil
+}
+
+// ValidateTLS is like Validate, but additionally checks that the certificate
+// and key files that would be passed to ListenAndServeTLS exist.
+func (srv *Server) ValidateTLS(certFile, keyFile string) error {
+	if err := srv.Validate(); err != nil {
+		return err
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if file == "" {
+			if srv.TLSConfig == nil || (len(srv.TLSConfig.Certificates) == 0 && srv.TLSConfig.GetCertificate == nil) {
+				return errors.New("no TLS certificate configured")
+			}
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
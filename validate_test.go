@@ -0,0 +1,75 @@
+package graceful
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() *Server {
+		return &Server{Timeout: killTime, Server: &http.Server{Handler: http.NotFoundHandler()}}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Server)
+		ok     bool
+	}{
+		{"valid", func(srv *Server) {}, true},
+		{"nil server", func(srv *Server) { srv.Server = nil }, false},
+		{"nil handler", func(srv *Server) { srv.Handler = nil }, false},
+		{"default mux", func(srv *Server) {
+			srv.Handler = nil
+			srv.AllowDefaultMux = true
+		}, true},
+		{"negative timeout", func(srv *Server) { srv.Timeout = -time.Second }, false},
+		{"negative listen limit", func(srv *Server) { srv.ListenLimit = -1 }, false},
+		{"negative listen backlog", func(srv *Server) { srv.ListenBacklog = -1 }, false},
+		{"negative rebind on failure", func(srv *Server) { srv.RebindOnFailure = -1 }, false},
+		{"negative keep-alive", func(srv *Server) { srv.TCPKeepAlive = -time.Second }, false},
+		{"negative max in flight", func(srv *Server) { srv.MaxInFlight = -1 }, false},
+		{"negative listener close delay", func(srv *Server) { srv.ListenerCloseDelay = -1 }, false},
+		{"negative drain accept grace", func(srv *Server) { srv.DrainAcceptGrace = -1 }, false},
+		{"negative max conn lifetime", func(srv *Server) { srv.MaxConnLifetime = -1 }, false},
+		{"negative max conns per ip", func(srv *Server) { srv.MaxConnsPerIP = -1 }, false},
+		{"negative kill rate", func(srv *Server) { srv.KillRate = -1 }, false},
+		{"negative max concurrent closes", func(srv *Server) { srv.MaxConcurrentCloses = -1 }, false},
+		{"unknown kill order", func(srv *Server) { srv.KillOrder = KillIdleFirst + 1 }, false},
+		{"negative accept idle warning", func(srv *Server) { srv.AcceptIdleWarn = -time.Second }, false},
+		{"negative post-kill grace", func(srv *Server) { srv.PostKillGrace = -time.Second }, false},
+		{"negative poll drain", func(srv *Server) { srv.PollDrain = -time.Second }, false},
+		{"negative min drain", func(srv *Server) { srv.MinDrainTime = -time.Second }, false},
+		{"negative memory limit duration", func(srv *Server) { srv.MemoryLimitDuration = -time.Second }, false},
+		{"negative escalation", func(srv *Server) { srv.EscalationTimeouts = []time.Duration{time.Second, -time.Second} }, false},
+		{"signal modes", func(srv *Server) { srv.SignalModes = map[os.Signal]ShutdownMode{os.Interrupt: Immediate} }, true},
+		{"signal modes without signals", func(srv *Server) {
+			srv.SignalModes = map[os.Signal]ShutdownMode{os.Interrupt: Immediate}
+			srv.NoSignalHandling = true
+		}, false},
+		{"invalid signal mode", func(srv *Server) { srv.SignalModes = map[os.Signal]ShutdownMode{os.Interrupt: 42} }, false},
+	}
+
+	for _, test := range tests {
+		srv := valid()
+		test.modify(srv)
+		if err := srv.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	srv := &Server{Server: &http.Server{Handler: http.NotFoundHandler()}}
+
+	if err := srv.ValidateTLS("test-fixtures/cert.crt", "test-fixtures/key.pem"); err != nil {
+		t.Errorf("expected existing files to validate, got %v", err)
+	}
+	if err := srv.ValidateTLS("test-fixtures/missing.crt", "test-fixtures/key.pem"); err == nil {
+		t.Error("expected a missing certificate file to be reported")
+	}
+	if err := srv.ValidateTLS("", ""); err == nil {
+		t.Error("expected a missing certificate to be reported")
+	}
+}
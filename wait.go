@@ -0,0 +1,45 @@
+package graceful
+
+// Wait blocks until the server has fully stopped, after being started with
+// Serve, ServeAsync or any other serving method, possibly from another
+// goroutine, and returns the error that method returned. With
+// BackgroundDrain it also waits for the drain to complete. If the server
+// isn't started, Wait blocks until it is started and has stopped.
+func (srv *Server) Wait() error {
+	<-srv.servedChan()
+
+	srv.chanLock.RLock()
+	defer srv.chanLock.RUnlock()
+
+	return srv.serveErr
+}
+
+// servedChan returns the channel closed by setServed.
+func (srv *Server) servedChan() chan struct{} {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.served == nil {
+		srv.served = make(chan struct{})
+	}
+	return srv.served
+}
+
+// setServed records err as what Serve returned and wakes up Wait. Serve
+// may be called again after failing to start, in which case Wait reports
+// the latest error.
+func (srv *Server) setServed(err error) {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	select {
+	case <-srv.served:
+		srv.served = nil
+	default:
+	}
+	if srv.served == nil {
+		srv.served = make(chan struct{})
+	}
+	srv.serveErr = err
+	close(srv.served)
+}
@@ -0,0 +1,58 @@
+package graceful
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	for _, background := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &Server{
+			Server:             &http.Server{Handler: http.NotFoundHandler()},
+			StdErrServerClosed: true,
+			BackgroundDrain:    background,
+			NoSignalHandling:   true,
+		}
+		waited := make(chan error, 1)
+		go func() {
+			waited <- srv.Wait()
+		}()
+		ready, _ := srv.ServeAsync(l)
+		<-ready
+
+		srv.Stop(killTime)
+		select {
+		case err := <-waited:
+			if err != http.ErrServerClosed {
+				t.Errorf("expected http.ErrServerClosed, got %v", err)
+			}
+		case <-time.After(timeoutTime):
+			t.Fatal("Timed out while waiting for Wait to return")
+		}
+		select {
+		case <-srv.StopChan():
+		default:
+			t.Error("expected Wait to return only once the server has stopped")
+		}
+	}
+}
+
+func TestWaitStartError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: &http.Server{}, NoSignalHandling: true}
+	if _, errc := srv.ServeAsync(l); <-errc != ErrNoHandler {
+		t.Fatal("expected ErrNoHandler")
+	}
+	if err := srv.Wait(); err != ErrNoHandler {
+		t.Errorf("expected Wait to return ErrNoHandler, got %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package graceful
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds each request to the ShutdownWebhook.
+const webhookTimeout = 2 * time.Second
+
+// webhookPayload is the JSON body posted to the ShutdownWebhook.
+type webhookPayload struct {
+	Event       string    `json:"event"`
+	Server      string    `json:"server,omitempty"`
+	Time        time.Time `json:"time"`
+	Connections int       `json:"connections"`
+	Killed      int       `json:"killed"`
+	Duration    float64   `json:"duration_seconds"`
+}
+
+// notifyWebhook posts kind to the ShutdownWebhook, if set, with the number
+// of connections killed. Failures are logged. The returned channel is
+// closed once the request has completed or timed out.
+func (srv *Server) notifyWebhook(kind EventKind, killed int) <-chan struct{} {
+	sent := make(chan struct{})
+	if srv.ShutdownWebhook == "" {
+		close(sent)
+		return sent
+	}
+
+	snap := srv.Snapshot()
+	payload := webhookPayload{
+		Event:       kind.String(),
+		Server:      srv.Name,
+		Time:        time.Now(),
+		Connections: snap.Connections,
+		Killed:      killed,
+		Duration:    snap.SinceShutdown.Seconds(),
+	}
+	go func() {
+		defer close(sent)
+
+		b, err := json.Marshal(payload)
+		if err != nil {
+			srv.logw(LevelError, map[string]interface{}{"error": err}, "shutdown webhook: %s", err)
+			return
+		}
+		client := &http.Client{Timeout: webhookTimeout}
+		resp, err := client.Post(srv.ShutdownWebhook, "application/json", bytes.NewReader(b))
+		if err != nil {
+			srv.logw(LevelWarn, map[string]interface{}{"error": err, "event": payload.Event}, "shutdown webhook: %s", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			srv.logw(LevelWarn, map[string]interface{}{"status": resp.StatusCode, "event": payload.Event}, "shutdown webhook: unexpected status %s", resp.Status)
+		}
+	}()
+	return sent
+}
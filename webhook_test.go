@@ -0,0 +1,88 @@
+package graceful
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownWebhook(t *testing.T) {
+	payloads := make(chan webhookPayload, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		payloads <- p
+	}))
+	defer hook.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		Name:             "api",
+		ShutdownWebhook:  hook.URL,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for shutdown")
+	}
+
+	// The server returns only once the completion has been delivered, but
+	// the start notification may still be in flight.
+	got := map[string]webhookPayload{}
+	for len(got) < 2 {
+		select {
+		case p := <-payloads:
+			got[p.Event] = p
+		case <-time.After(timeoutTime):
+			t.Fatalf("expected draining and stopped notifications, got %v", got)
+		}
+	}
+	for _, event := range []string{"draining", "stopped"} {
+		if p, ok := got[event]; !ok || p.Server != "api" {
+			t.Errorf("expected a %s notification for api, got %+v", event, p)
+		}
+	}
+}
+
+func TestShutdownWebhookFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on the closed listener's address.
+	unreachable := "http://" + l.Addr().String()
+	l.Close()
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Server:           &http.Server{Handler: http.NotFoundHandler()},
+		ShutdownWebhook:  unreachable,
+		NoSignalHandling: true,
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	srv.Stop(killTime)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(webhookTimeout + timeoutTime):
+		t.Fatal("expected shutdown to complete despite the failing webhook")
+	}
+}
@@ -0,0 +1,137 @@
+package graceful
+
+import "net/http"
+
+// exposeWriter returns w, which wraps the ResponseWriter under, as a
+// ResponseWriter implementing exactly those of http.Flusher, http.Hijacker,
+// http.Pusher and http.CloseNotifier that under implements, so that
+// handlers can tell what the connection supports. The methods w defines
+// itself take precedence over under's.
+func exposeWriter(w, under http.ResponseWriter) http.ResponseWriter {
+	var mask int
+	flusher, ok := under.(http.Flusher)
+	if ok {
+		mask |= 1
+		if f, ok := w.(http.Flusher); ok {
+			flusher = f
+		}
+	}
+	hijacker, ok := under.(http.Hijacker)
+	if ok {
+		mask |= 2
+		if h, ok := w.(http.Hijacker); ok {
+			hijacker = h
+		}
+	}
+	pusher, ok := under.(http.Pusher)
+	if ok {
+		mask |= 4
+		if p, ok := w.(http.Pusher); ok {
+			pusher = p
+		}
+	}
+	notifier, ok := under.(http.CloseNotifier)
+	if ok {
+		mask |= 8
+		if n, ok := w.(http.CloseNotifier); ok {
+			notifier = n
+		}
+	}
+
+	switch mask {
+	case 0:
+		return struct{ http.ResponseWriter }{w}
+	case 1:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, flusher}
+	case 2:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, hijacker}
+	case 1 | 2:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, flusher, hijacker}
+	case 4:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, pusher}
+	case 1 | 4:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, flusher, pusher}
+	case 2 | 4:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, hijacker, pusher}
+	case 1 | 2 | 4:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, flusher, hijacker, pusher}
+	case 8:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+		}{w, notifier}
+	case 1 | 8:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+		}{w, flusher, notifier}
+	case 2 | 8:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.CloseNotifier
+		}{w, hijacker, notifier}
+	case 1 | 2 | 8:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+		}{w, flusher, hijacker, notifier}
+	case 4 | 8:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+			http.CloseNotifier
+		}{w, pusher, notifier}
+	case 1 | 4 | 8:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+			http.CloseNotifier
+		}{w, flusher, pusher, notifier}
+	case 2 | 4 | 8:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{w, hijacker, pusher, notifier}
+	default:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{w, flusher, hijacker, pusher, notifier}
+	}
+}